@@ -1,121 +1,246 @@
 package clibs
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/url"
+	"path/filepath"
 	"runtime"
+	"time"
 )
 
+// Build builds libs for the target in config
 func Build(config Config, libs []*Lib) error {
-	if config.Goos == "" {
-		config.Goos = runtime.GOOS
-	}
-	if config.Goarch == "" {
-		config.Goarch = runtime.GOARCH
-	}
+	return BuildContext(context.Background(), config, libs)
+}
 
-	if len(libs) == 0 {
-		fmt.Println("\nBuilding C library libs:")
-	} else {
-		fmt.Println("\nChecking specified libs for lib.yaml files:")
+// BuildContext is like Build, cancelling child processes and downloads
+// when ctx is done. If config has Targets, every lib is built for each of
+// them and the first failure is returned after all builds. Errors are of
+// type *Error.
+func BuildContext(ctx context.Context, config Config, libs []*Lib) error {
+	if len(config.Targets) > 0 {
+		for _, result := range BuildTargets(ctx, config, libs) {
+			if result.Err != nil {
+				return result.Err
+			}
+		}
+		return nil
 	}
-
+	config = config.buildDefaults()
 	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	config.libLogger(nil).debugf("Building %d libs for %s (%s)", len(libs), targetTriple, config.Profile)
 	for _, lib := range libs {
-		fmt.Printf("  %#v\n", lib)
-		buildDir, err := lib.checkOrBuild(config)
-		if err != nil {
-			fmt.Printf("  Error processing %s: %v\n", lib.ModName, err)
+		if _, err := lib.buildTarget(ctx, config); err != nil {
 			return err
 		}
-		lib.Env = getBuildEnv(lib, buildDir, config.Goos, config.Goarch, targetTriple)
 	}
-
 	return nil
 }
 
-func (lib *Lib) checkOrBuild(config Config) (dir string, err error) {
-	if !config.Force && lib.Sum != "" {
+// BuildResult is the outcome of building a lib for a target
+type BuildResult struct {
+	Lib    *Lib
+	Target Target
+	// Dir is the build or prebuilt dir of the lib
+	Dir string
+	Env []string
+	Err error
+}
+
+// Prebuilt reports whether a prebuilt lib was used
+func (r BuildResult) Prebuilt() bool {
+	return r.Dir != "" && filepath.Base(filepath.Dir(r.Dir)) == PrebuiltDirName
+}
+
+// BuildTargets builds every lib for every target in config.Targets, or
+// for Goos and Goarch if there are none. Sources are fetched once and
+// shared by all targets. Unlike BuildContext it does not stop at a failed
+// build, results are in lib-major order. lib.Env is left set for the last
+// target built successfully.
+func BuildTargets(ctx context.Context, config Config, libs []*Lib) []BuildResult {
+	targets := config.Targets
+	if len(targets) == 0 {
+		config = config.buildDefaults()
+		targets = []Target{{Goos: config.Goos, Goarch: config.Goarch}}
+	}
+	results := make([]BuildResult, 0, len(libs)*len(targets))
+	for _, lib := range libs {
+		for _, target := range targets {
+			targetConfig := config
+			targetConfig.Goos, targetConfig.Goarch = target.Goos, target.Goarch
+			targetConfig = targetConfig.buildDefaults()
+			result := BuildResult{Lib: lib, Target: target}
+			if err := ctx.Err(); err != nil {
+				result.Err = newError(lib, getTargetTriple(target.Goos, target.Goarch), PhaseBuild, err)
+			} else {
+				result.Dir, result.Err = lib.buildTarget(ctx, targetConfig)
+				if result.Err == nil {
+					result.Env = lib.Env
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// buildDefaults fills in the host target, profile and logger
+func (c Config) buildDefaults() Config {
+	if c.Goos == "" {
+		c.Goos = runtime.GOOS
+	}
+	if c.Goarch == "" {
+		c.Goarch = runtime.GOARCH
+	}
+	c.Profile = c.Profile.normalize()
+	c.Logger = c.logger()
+	return c
+}
+
+// buildTarget builds lib for the target of config and sets its Env
+func (lib *Lib) buildTarget(ctx context.Context, config Config) (string, error) {
+	log := config.libLogger(lib)
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	log.debugf("module %s at %s, sum %q", lib.ModName, lib.Path, lib.Sum)
+	if err := migrateLegacyBaseDir(config, lib); err != nil {
+		log.warnf("Failed to migrate cache dir: %v", err)
+	}
+	buildDir, err := lib.checkOrBuild(ctx, config)
+	if err != nil {
+		return "", newError(lib, targetTriple, PhaseBuild, err)
+	}
+	if lib.Env, err = getBuildEnv(config, lib, buildDir); err != nil {
+		return "", newError(lib, targetTriple, PhaseBuild, err)
+	}
+	if err := touchLastUse(config, lib); err != nil {
+		log.debugf("Failed to record last use: %v", err)
+	}
+	return buildDir, nil
+}
+
+func (lib *Lib) checkOrBuild(ctx context.Context, config Config) (dir string, err error) {
+	if reason := lib.prebuiltSkipReason(config); reason == "" {
 		if !config.Prebuilt {
 			if prebuiltDir, err := lib.checkPrebuiltStatus(config); err == nil && prebuiltDir != "" {
 				return prebuiltDir, nil
 			}
 		}
-		if prebuiltDir, err := lib.tryDownloadPrebuilt(config); err == nil && prebuiltDir != "" {
+		prebuiltDir, err := lib.tryDownloadPrebuilt(ctx, config)
+		if err == nil && prebuiltDir != "" {
 			return prebuiltDir, nil
 		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if config.PrebuiltPolicy == PrebuiltRequire {
+			var e *Error
+			if errors.As(err, &e) {
+				err = e.Err
+			}
+			return "", newError(lib, getTargetTriple(config.Goos, config.Goarch), PhasePrebuilt, fmt.Errorf("prebuilt lib required: %w", err))
+		}
+	} else if config.PrebuiltPolicy == PrebuiltRequire && lib.Sum != "" {
+		return "", newError(lib, getTargetTriple(config.Goos, config.Goarch), PhasePrebuilt, fmt.Errorf("prebuilt lib required: %s", reason))
 	}
 	dirName := BuildDirName
 	if config.Prebuilt {
 		dirName = PrebuiltDirName
 	}
-	buildDir, err := lib.tryBuildLib(config, dirName)
-	if err != nil {
-		fmt.Printf("  Error processing %s: %v\n", lib.ModName, err)
-		return "", err
-	}
-	return buildDir, nil
+	return lib.tryBuildLib(ctx, config, dirName)
 }
 
-func (lib *Lib) tryDownloadPrebuilt(config Config) (string, error) {
-	name := lib.Config.Name
+func (lib *Lib) checkPrebuiltStatus(config Config) (string, error) {
+	log := config.libLogger(lib)
 	targetTriple := getTargetTriple(config.Goos, config.Goarch)
-	prebuiltRootDir := getPrebuiltDir(lib)
-	uriEncodedTag := url.PathEscape(fmt.Sprintf("%s/%s", name, lib.Config.Version))
-	url := fmt.Sprintf("%s/%s/%s-%s-%s.tar.gz", ReleaseUrlPrefix, uriEncodedTag, name, lib.Config.Version, targetTriple)
-	fmt.Printf("  Downloading prebuilt lib: %s\n", url)
-	fmt.Printf("    to: %s\n", prebuiltRootDir)
-	if err := fetchFromFiles([]FileSpec{{URL: url}}, prebuiltRootDir, false); err != nil {
+	prebuiltTargetDir, err := getBuildDirByName(config, lib, PrebuiltDirName, getTargetDirName(targetTriple, config.Profile))
+	if err != nil {
 		return "", err
 	}
-	prebuiltTargetDir := getBuildDirByName(lib, PrebuiltDirName, config.Goos, config.Goarch, targetTriple)
-	lib.Env = getBuildEnv(lib, prebuiltTargetDir, config.Goos, config.Goarch, targetTriple)
-	return prebuiltTargetDir, nil
-}
-
-func (lib *Lib) checkPrebuiltStatus(config Config) (string, error) {
-	targetTriple := getTargetTriple(config.Goos, config.Goarch)
-	prebuiltTargetDir := getBuildDirByName(lib, PrebuiltDirName, config.Goos, config.Goarch, targetTriple)
-	if matched, err := checkHash(prebuiltTargetDir, lib.Config, true); err != nil || !matched {
-		fmt.Printf("  No prebuilt lib  found in %s\n", prebuiltTargetDir)
+	if matched, err := checkHash(log, prebuiltTargetDir, buildInputs(lib.Config, config.Profile)); err != nil || !matched {
+		log.debugf("No prebuilt lib found in %s (matched: %v, err: %v)", prebuiltTargetDir, matched, err)
+		return "", err
+	}
+	if err := verifyOutputs(prebuiltTargetDir); err != nil {
+		log.warnf("Prebuilt lib in %s is corrupted: %v", prebuiltTargetDir, err)
+		return "", err
+	}
+	if err := config.checkVerification(prebuiltTargetDir); err != nil {
+		log.infof("not reusing prebuilt lib in %s: %v", prebuiltTargetDir, err)
+		return "", nil
+	}
+	log.infof("using prebuilt lib in %s", prebuiltTargetDir)
+	if lib.Env, err = getBuildEnv(config, lib, prebuiltTargetDir); err != nil {
 		return "", err
 	}
-	fmt.Printf("  Found prebuilt lib in %s\n", prebuiltTargetDir)
-	lib.Env = getBuildEnv(lib, prebuiltTargetDir, config.Goos, config.Goarch, targetTriple)
 	return prebuiltTargetDir, nil
 }
 
 // Build the library both build and prebuilt
-func (lib *Lib) tryBuildLib(config Config, buildDirName string) (string, error) {
+func (lib *Lib) tryBuildLib(ctx context.Context, config Config, buildDirName string) (string, error) {
+	log := config.libLogger(lib)
 	targetTriple := getTargetTriple(config.Goos, config.Goarch)
-	buildTargetDir := getBuildDirByName(lib, buildDirName, config.Goos, config.Goarch, targetTriple)
+	buildTargetDir, err := getBuildDirByName(config, lib, buildDirName, getTargetDirName(targetTriple, config.Profile))
+	if err != nil {
+		return "", err
+	}
 	if !config.Force {
-		if matched, err := checkHash(buildTargetDir, lib.Config, true); err == nil && matched {
-			fmt.Printf("  Found built lib in %s\n", buildTargetDir)
-			return buildTargetDir, nil
+		if matched, err := checkHash(log, buildTargetDir, buildInputs(lib.Config, config.Profile)); err == nil && matched {
+			if err := verifyOutputs(buildTargetDir); err != nil {
+				log.warnf("Built lib in %s is corrupted, rebuilding: %v", buildTargetDir, err)
+			} else if !config.hasCompileCommands(buildTargetDir) {
+				log.infof("rebuilding to record compile commands")
+			} else {
+				log.infof("up to date in %s", buildTargetDir)
+				return buildTargetDir, nil
+			}
+		} else {
+			log.debugf("No built lib found in %s (matched: %v, err: %v)", buildTargetDir, matched, err)
 		}
 	}
-	fmt.Printf("  No built lib found in %s\n", buildTargetDir)
 
-	downloadDir := getDownloadDir(lib)
-	if matched, err := checkHash(downloadDir, lib.Config, false); err != nil || !matched {
-		fmt.Printf("matched: %v, err: %v\n", matched, err)
-		fmt.Printf("  No download lib found in %s\n", downloadDir)
-		if err := lib.fetchLib(); err != nil {
-			fmt.Printf("  Error fetching library: %v\n", err)
+	// Versioned modules share identical builds through the store
+	if lib.Sum != "" && buildDirName == BuildDirName {
+		if ok, err := lib.tryStoreBuild(ctx, config, buildTargetDir); err != nil {
 			return "", err
+		} else if ok {
+			return buildTargetDir, nil
 		}
 	}
-	fmt.Printf("  Found download lib in %s\n", downloadDir)
-
-	if err := lib.buildLib(config, buildTargetDir); err != nil {
-		fmt.Printf("  Error building lib: %v\n", err)
+	if err := lib.fetchAndBuild(ctx, config, buildTargetDir); err != nil {
 		return "", err
 	}
+	return buildTargetDir, nil
+}
 
-	if err := saveHash(buildTargetDir, lib.Config, true); err != nil {
-		fmt.Printf("  Error saving hash: %v\n", err)
-		return "", err
+// fetchAndBuild fetches the sources of lib if needed and builds them into
+// buildDir
+func (lib *Lib) fetchAndBuild(ctx context.Context, config Config, buildDir string) error {
+	log := config.libLogger(lib)
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	if lib.Config.Git != nil {
+		// TODO: Implement Git checkout
+		return newError(lib, targetTriple, PhaseFetch, fmt.Errorf("git checkout not implemented yet"))
 	}
-	return buildTargetDir, nil
+	downloadDir, err := getDownloadDir(config, lib)
+	if err != nil {
+		return err
+	}
+	if matched, err := checkHash(log, downloadDir, downloadInputs(lib.Config)); err != nil || !matched {
+		log.debugf("No download lib found in %s (matched: %v, err: %v)", downloadDir, matched, err)
+		log.infof("fetching %s", lib.Config.Version)
+		if err := lib.fetchLib(ctx, config); err != nil {
+			return newError(lib, targetTriple, PhaseFetch, err)
+		}
+	} else {
+		log.debugf("Found download lib in %s", downloadDir)
+	}
+
+	log.infof("building for %s", targetTriple)
+	start := time.Now()
+	if err := lib.buildLib(ctx, config, buildDir); err != nil {
+		return newError(lib, targetTriple, PhaseBuild, err)
+	}
+	log.infof("built in %s to %s", time.Since(start).Round(time.Millisecond), buildDir)
+	return nil
 }
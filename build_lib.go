@@ -1,9 +1,10 @@
 package clibs
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
@@ -61,30 +62,36 @@ func getTargetTriple(goos, goarch string) string {
 }
 
 // getBuildEnv prepares build environment variables
-func getBuildEnv(lib *Lib, buildDir, platform, arch, targetTriple string) []string {
+func getBuildEnv(config Config, lib *Lib, buildDir string) ([]string, error) {
 	// Generate build flags
-	cflags, ldflags := getBuildFlags(targetTriple)
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	cflags, ldflags := getBuildFlags(targetTriple, config.Profile)
 
-	downloadDir := getDownloadDir(lib)
+	downloadDir, err := getDownloadDir(config, lib)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create environment variables
 	return []string{
 		fmt.Sprintf("%s=%s", EnvPackageDir, lib.Path),
 		fmt.Sprintf("%s=%s", EnvDownloadDir, downloadDir),
-		fmt.Sprintf("%s=%s", EnvBuildGoos, platform),
-		fmt.Sprintf("%s=%s", EnvBuildGoarch, arch),
+		fmt.Sprintf("%s=%s", EnvBuildGoos, config.Goos),
+		fmt.Sprintf("%s=%s", EnvBuildGoarch, config.Goarch),
 		fmt.Sprintf("%s=%s", EnvBuildTarget, targetTriple),
 		fmt.Sprintf("%s=%s", EnvBuildCflags, cflags),
 		fmt.Sprintf("%s=%s", EnvBuildLdflags, ldflags),
 		fmt.Sprintf("%s=%s", EnvBuildDir, buildDir),
-	}
+		fmt.Sprintf("%s=%s", EnvBuildProfile, config.Profile.normalize()),
+	}, nil
 }
 
-// getBuildFlags generates build flags based on target triple
-func getBuildFlags(targetTriple string) (cflags, ldflags string) {
-	// Default flags
-	cflags = "-O2"
-	ldflags = ""
+// getBuildFlags generates build flags based on target triple and profile
+func getBuildFlags(targetTriple string, profile Profile) (cflags, ldflags string) {
+	// Profile flags
+	flags := profiles[profile.normalize()]
+	cflags = flags.cflags
+	ldflags = flags.ldflags
 
 	// Add target-specific flags
 	if strings.Contains(targetTriple, "wasm32") {
@@ -101,9 +108,14 @@ func getBuildFlags(targetTriple string) (cflags, ldflags string) {
 }
 
 // buildLib builds the library using the appropriate build method
-func (lib *Lib) buildLib(config Config, buildDir string) error {
+func (lib *Lib) buildLib(ctx context.Context, config Config, buildDir string) error {
+	log := config.libLogger(lib)
+
 	// Get download directory
-	downloadDir := getDownloadDir(lib)
+	downloadDir, err := getDownloadDir(config, lib)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(downloadDir); err != nil {
 		// If download directory doesn't exist, try to create it
 		if os.IsNotExist(err) {
@@ -120,44 +132,72 @@ func (lib *Lib) buildLib(config Config, buildDir string) error {
 		return fmt.Errorf("failed to create build directory: %v", err)
 	}
 
-	fmt.Printf("  Build directory: %s\n", buildDir)
-
-	// Check if we need to download files
-	if lib.Config.Git != nil {
-		// TODO: Implement Git checkout
-		return fmt.Errorf("git checkout not implemented yet")
-	} else if len(lib.Config.Files) > 0 {
-		// Download files
-		if err := lib.fetchLib(); err != nil {
-			return fmt.Errorf("failed to fetch library: %v", err)
-		}
+	// Invalidate the old state so a failed build is never reused
+	if err := os.Remove(filepath.Join(buildDir, BuildHashFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old hash file: %v", err)
 	}
 
+	log.debugf("Build directory: %s", buildDir)
+
 	// If there's a build command, execute it
 	if lib.Config.Build != nil && lib.Config.Build.Command != "" {
-		fmt.Printf("  Executing build command:\n%s\n", lib.Config.Build.Command)
+		log.debugf("Executing build command:\n%s", lib.Config.Build.Command)
 
 		// Get environment variables
-		targetTriple := getTargetTriple(config.Goos, config.Goarch)
-		env := getBuildEnv(lib, buildDir, config.Goos, config.Goarch, targetTriple)
+		env, err := getBuildEnv(config, lib, buildDir)
+		if err != nil {
+			return err
+		}
 		lib.Env = env
 
-		fmt.Printf("  Environment variables:\n%s\n", strings.Join(append(os.Environ(), env...), "\n"))
+		var recorder *compileRecorder
+		if config.CompileCommands {
+			if recorder, err = newCompileRecorder(); err != nil {
+				return err
+			}
+			defer recorder.Close()
+			env = append(env[:len(env):len(env)], recorder.env()...)
+		}
+
+		log.debugf("Environment variables:\n%s", strings.Join(env, "\n"))
 		// Create the build command
-		cmd := exec.Command("bash", "-e", "-c", lib.Config.Build.Command)
+		stepCtx, cancel := config.stepContext(ctx)
+		defer cancel()
+		cmd := commandContext(stepCtx, "bash", "-e", "-c", lib.Config.Build.Command)
 		cmd.Dir = downloadDir
 		cmd.Env = append(os.Environ(), env...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		output := log.output()
+		cmd.Stdout = output
+		cmd.Stderr = output
 
 		// Execute the build command
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("build command failed: %v", err)
+			return fmt.Errorf("build command failed: %w\n%s", runError(stepCtx, err), output.Tail())
+		}
+
+		if recorder != nil {
+			commands, err := recorder.commands()
+			if err != nil {
+				return err
+			}
+			if err := writeCompileCommands(filepath.Join(buildDir, CompileCommandsFile), commands); err != nil {
+				return fmt.Errorf("failed to write %s: %v", CompileCommandsFile, err)
+			}
+			log.debugf("Recorded %d compile commands", len(commands))
 		}
 	}
 
+	if err := lib.writePkgConfig(buildDir); err != nil {
+		return fmt.Errorf("failed to write pkg-config file: %v", err)
+	}
+
+	// Record the produced files before marking the build successful
+	if _, err := WriteManifest(buildDir); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
 	// Write hash file to mark successful build
-	if err := saveHash(buildDir, lib.Config, true); err != nil {
+	if err := saveHash(buildDir, buildInputs(lib.Config, config.Profile)); err != nil {
 		return fmt.Errorf("failed to write hash file: %v", err)
 	}
 
@@ -1,8 +1,15 @@
 package clibs
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -145,3 +152,60 @@ func TestGetTargetTriple(t *testing.T) {
 	checkTriple(t, "windows/386", "windows", "386", "i386-unknown-windows")
 	checkTriple(t, "js/wasm", "js", "wasm", "wasm32-unknown-js")
 }
+
+func TestBuildTargets(t *testing.T) {
+	var mu sync.Mutex
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		downloads++
+		mu.Unlock()
+		w.Write([]byte("source"))
+	}))
+	defer server.Close()
+
+	lib := &Lib{
+		ModName: "example.com/matrix",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:    "matrix",
+			Version: "1.0",
+			Files:   []FileSpec{{URL: server.URL + "/matrix.c", NoExtract: true}},
+			Build: &BuildSpec{
+				Command: `test "$CLIBS_BUILD_TARGET" != wasm32-unknown-wasip1 && cp matrix.c "$CLIBS_BUILD_DIR/"`,
+			},
+		},
+	}
+	config := Config{
+		Targets: []Target{{"linux", "amd64"}, {"linux", "arm64"}, {"wasip1", "wasm"}},
+		Logger:  Discard,
+	}
+	results := BuildTargets(context.Background(), config, []*Lib{lib})
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for _, result := range results[:2] {
+		if result.Err != nil {
+			t.Fatalf("%s: %v", result.Target, result.Err)
+		}
+		if _, err := os.Stat(filepath.Join(result.Dir, "matrix.c")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if results[0].Dir == results[1].Dir {
+		t.Fatalf("targets share build dir %s", results[0].Dir)
+	}
+	var e *Error
+	if !errors.As(results[2].Err, &e) || e.Target != "wasm32-unknown-wasip1" {
+		t.Fatalf("failed target not reported: %v", results[2].Err)
+	}
+	if results[2].Env != nil {
+		t.Fatalf("failed target has the env of another target: %v", results[2].Env)
+	}
+	if downloads != 1 {
+		t.Fatalf("sources downloaded %d times, want 1", downloads)
+	}
+	if err := BuildContext(context.Background(), config, []*Lib{lib}); err == nil {
+		t.Fatal("failed target not returned by BuildContext")
+	}
+}
@@ -0,0 +1,392 @@
+package clibs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheRoot returns the root of the shared build cache
+func (c Config) cacheRoot() (string, error) {
+	if c.CacheDir != "" {
+		return filepath.Abs(c.CacheDir)
+	}
+	if dir := os.Getenv(EnvCacheDir); dir != "" {
+		return filepath.Abs(dir)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate build cache: %v", err)
+	}
+	return filepath.Join(home, ".llgo", "clibs_build"), nil
+}
+
+// outOfTree reports whether local modules are built in the cache
+func (c Config) outOfTree() bool {
+	return c.OutOfTree || os.Getenv(EnvOutOfTree) == "1"
+}
+
+// touchLastUse records that the cached build state of lib was used.
+// Local modules built in place are not tracked.
+func touchLastUse(config Config, lib *Lib) error {
+	baseDir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		return err
+	}
+	if baseDir == lib.Path {
+		return nil
+	}
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	return os.WriteFile(filepath.Join(baseDir, LastUseFile), []byte(now+"\n"), 0644)
+}
+
+// readLastUse returns when the build state in baseDir was last used,
+// falling back to the newest modification time of its directories.
+func readLastUse(baseDir string) time.Time {
+	if content, err := os.ReadFile(filepath.Join(baseDir, LastUseFile)); err == nil {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content))); err == nil {
+			return t
+		}
+	}
+	var last time.Time
+	for _, name := range []string{DownloadDirName, BuildDirName, PrebuiltDirName} {
+		if fi, err := os.Stat(filepath.Join(baseDir, name)); err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last
+}
+
+// isCacheEntry reports whether dir holds the build state of a module
+func isCacheEntry(dir string) bool {
+	for _, name := range []string{DownloadDirName, BuildDirName, PrebuiltDirName, LastUseFile} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheEntry is the build state of one module version in the cache, or a
+// build output in the store shared by module versions
+type CacheEntry struct {
+	Dir     string
+	Module  string
+	Key     string
+	Size    int64
+	LastUse time.Time
+	// Store is set for build outputs in the store, which have no module
+	Store bool
+	// List is set for the module lists of ListLibs cached in
+	// ListCacheDirName, which only PruneCache reports
+	List bool
+	// Links lists the store dirs the build dirs of a module version use
+	Links []string
+}
+
+// CacheEntries lists every module version and store dir in the build
+// cache, largest first. The size of a module version does not include the
+// store dirs it links.
+func CacheEntries(config Config) ([]CacheEntry, error) {
+	root, err := config.cacheRoot()
+	if err != nil {
+		return nil, err
+	}
+	storeRoot := filepath.Join(root, StoreDirName)
+	var entries []CacheEntry
+	lastUse := make(map[string]time.Time)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if path == storeRoot || path == filepath.Join(root, ListCacheDirName) {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() || path == root || !isCacheEntry(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := CacheEntry{
+			Dir:     path,
+			Module:  unescapeModulePath(filepath.ToSlash(filepath.Dir(rel))),
+			Key:     filepath.Base(rel),
+			Size:    dirSize(path),
+			LastUse: readLastUse(path),
+			Links:   storeLinks(storeRoot, path),
+		}
+		for _, link := range entry.Links {
+			if entry.LastUse.After(lastUse[link]) {
+				lastUse[link] = entry.LastUse
+			}
+		}
+		entries = append(entries, entry)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan build cache: %v", err)
+	}
+
+	stored, err := os.ReadDir(storeRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to scan build store: %v", err)
+	}
+	for _, d := range stored {
+		// Lock files of store builds
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(storeRoot, d.Name())
+		entry := CacheEntry{Dir: dir, Key: d.Name(), Size: dirSize(dir), LastUse: lastUse[dir], Store: true}
+		if entry.LastUse.IsZero() {
+			if fi, err := d.Info(); err == nil {
+				entry.LastUse = fi.ModTime()
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Size > entries[j].Size
+	})
+	return entries, nil
+}
+
+// storeLinks returns the store dirs linked from the build dirs of a module
+// version
+func storeLinks(storeRoot, baseDir string) []string {
+	var links []string
+	targets, _ := os.ReadDir(filepath.Join(baseDir, BuildDirName))
+	for _, target := range targets {
+		link, err := os.Readlink(filepath.Join(baseDir, BuildDirName, target.Name()))
+		if err == nil && filepath.Dir(link) == storeRoot {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// PruneOptions selects the cache entries removed by PruneCache. A module
+// version is removed if any criterion matches, a store dir once no
+// remaining module version links it.
+type PruneOptions struct {
+	// Keep lists the libs referenced by projects. If non-nil, the entries
+	// of every other module version are removed.
+	Keep []*Lib
+	// UnusedFor removes entries not used within this duration
+	UnusedFor time.Duration
+	// MaxSize removes the least recently used entries until the cache
+	// is at most this many bytes
+	MaxSize int64
+	// DryRun reports the entries without removing them
+	DryRun bool
+}
+
+// PruneCache removes cache entries according to opts and returns them
+func PruneCache(config Config, opts PruneOptions) ([]CacheEntry, error) {
+	entries, err := CacheEntries(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var keep map[string]bool
+	if opts.Keep != nil {
+		keep = make(map[string]bool)
+		for _, lib := range opts.Keep {
+			baseDir, err := getBuildBaseDir(config, lib)
+			if err != nil {
+				return nil, err
+			}
+			keep[filepath.Clean(baseDir)] = true
+		}
+	}
+
+	// Least recently used first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUse.Before(entries[j].LastUse)
+	})
+
+	var total int64
+	refs := make(map[string]int)
+	stored := make(map[string]CacheEntry)
+	for _, entry := range entries {
+		total += entry.Size
+		if entry.Store {
+			stored[entry.Dir] = entry
+		}
+		for _, link := range entry.Links {
+			refs[link]++
+		}
+	}
+
+	var removed []CacheEntry
+	remove := func(entry CacheEntry) error {
+		if !opts.DryRun {
+			if err := os.RemoveAll(entry.Dir); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", entry.Dir, err)
+			}
+			if entry.Store {
+				os.Remove(entry.Dir + storeLockExt)
+			}
+		}
+		total -= entry.Size
+		removed = append(removed, entry)
+		return nil
+	}
+
+	for _, entry := range entries {
+		if entry.Store {
+			continue
+		}
+		switch {
+		case keep != nil && !keep[filepath.Clean(entry.Dir)]:
+		case opts.UnusedFor > 0 && time.Since(entry.LastUse) > opts.UnusedFor:
+		case opts.MaxSize > 0 && total > opts.MaxSize:
+		default:
+			continue
+		}
+		if err := remove(entry); err != nil {
+			return removed, err
+		}
+		for _, link := range entry.Links {
+			refs[link]--
+		}
+		// Free the store dirs only this module version used
+		for _, link := range entry.Links {
+			if store, ok := stored[link]; ok && refs[link] == 0 {
+				delete(stored, link)
+				if err := remove(store); err != nil {
+					return removed, err
+				}
+			}
+		}
+	}
+
+	// Store dirs no module version links, e.g. after clean
+	for _, entry := range entries {
+		if _, ok := stored[entry.Dir]; ok && refs[entry.Dir] == 0 {
+			if err := remove(entry); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	// Module lists are small, only their age matters
+	if opts.UnusedFor > 0 {
+		lists, err := listCacheEntries(config)
+		if err != nil {
+			return removed, err
+		}
+		for _, entry := range lists {
+			if time.Since(entry.LastUse) > opts.UnusedFor {
+				if err := remove(entry); err != nil {
+					return removed, err
+				}
+			}
+		}
+	}
+	return removed, nil
+}
+
+// listCacheEntries returns the module lists cached by ListLibs, their last
+// use being their mtime
+func listCacheEntries(config Config) ([]CacheEntry, error) {
+	root, err := config.cacheRoot()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, ListCacheDirName)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to scan module list cache: %v", err)
+	}
+	var entries []CacheEntry
+	for _, d := range files {
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			Dir:     filepath.Join(dir, d.Name()),
+			Key:     d.Name(),
+			Size:    info.Size(),
+			LastUse: info.ModTime(),
+			List:    true,
+		})
+	}
+	return entries, nil
+}
+
+// Clean removes the build state of libs. If allTargets is false, only the
+// build and prebuilt dirs of the target in config are removed, for every
+// profile. The source dir of local modules built in place is never removed.
+func Clean(config Config, libs []*Lib, allTargets bool) ([]string, error) {
+	if config.Goos == "" {
+		config.Goos = runtime.GOOS
+	}
+	if config.Goarch == "" {
+		config.Goarch = runtime.GOARCH
+	}
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+
+	var removed []string
+	remove := func(dir string) error {
+		if _, err := os.Lstat(dir); err != nil {
+			return nil
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", dir, err)
+		}
+		removed = append(removed, dir)
+		return nil
+	}
+
+	for _, lib := range libs {
+		baseDir, err := getBuildBaseDir(config, lib)
+		if err != nil {
+			return removed, err
+		}
+		if allTargets {
+			for _, name := range []string{DownloadDirName, DownloadDirName + "_tmp", BuildDirName, PrebuiltDirName, LastUseFile} {
+				if err := remove(filepath.Join(baseDir, name)); err != nil {
+					return removed, err
+				}
+			}
+			if baseDir != lib.Path {
+				// Drop the now empty cache entry
+				os.Remove(baseDir)
+			}
+			continue
+		}
+		for _, kind := range []string{BuildDirName, PrebuiltDirName} {
+			entries, err := os.ReadDir(filepath.Join(baseDir, kind))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if triple, _ := parseTargetDirName(entry.Name()); triple != targetTriple {
+					continue
+				}
+				if err := remove(filepath.Join(baseDir, kind, entry.Name())); err != nil {
+					return removed, err
+				}
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,186 @@
+package clibs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneCache(t *testing.T) {
+	config := Config{CacheDir: t.TempDir()}
+
+	libs := map[string]*Lib{}
+	for i, name := range []string{"old", "recent", "kept"} {
+		lib := &Lib{ModName: "example.com/" + name, Sum: "h1:" + name}
+		libs[name] = lib
+		dir, err := getBuildBaseDir(config, lib)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, BuildDirName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, BuildDirName, "lib.a"), make([]byte, 100*(i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := touchLastUse(config, lib); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, _ := getBuildBaseDir(config, libs["old"])
+	lastUse := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(filepath.Join(old, LastUseFile), []byte(lastUse), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Used after old but before kept
+	recent, _ := getBuildBaseDir(config, libs["recent"])
+	lastUse = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(filepath.Join(recent, LastUseFile), []byte(lastUse), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := CacheEntries(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Module != "example.com/kept" || entries[0].Size < 300 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	removed, err := PruneCache(config, PruneOptions{UnusedFor: 24 * time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Dir != old {
+		t.Fatalf("unexpected dry run result: %+v", removed)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Fatalf("dry run removed %s", old)
+	}
+
+	// The least recently used entry goes first when over the size limit
+	removed, err = PruneCache(config, PruneOptions{MaxSize: 350})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0].Dir != old || removed[1].Module != "example.com/recent" {
+		t.Fatalf("unexpected size prune result: %+v", removed)
+	}
+
+	if err := touchLastUse(config, libs["recent"]); err != nil {
+		t.Fatal(err)
+	}
+	removed, err = PruneCache(config, PruneOptions{Keep: []*Lib{libs["recent"]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = CacheEntries(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Module != "example.com/recent" {
+		t.Fatalf("unexpected entries after prune: %+v, removed %+v", entries, removed)
+	}
+}
+
+func TestPruneListCache(t *testing.T) {
+	config := Config{CacheDir: t.TempDir()}
+	dir := filepath.Join(config.CacheDir, ListCacheDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old.json", "recent.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("[]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastUse := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old.json"), lastUse, lastUse); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := PruneCache(config, PruneOptions{UnusedFor: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || !removed[0].List || removed[0].Key != "old.json" {
+		t.Fatalf("unexpected prune result: %+v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "recent.json")); err != nil {
+		t.Fatalf("recently used list removed: %v", err)
+	}
+}
+
+func TestCleanTarget(t *testing.T) {
+	lib := &Lib{ModName: "example.com/local", Path: t.TempDir()}
+	for _, name := range []string{"x86_64-unknown-linux", "x86_64-unknown-linux-debug", "arm64-apple-macosx11.0.0"} {
+		if err := os.MkdirAll(filepath.Join(lib.Path, BuildDirName, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := Clean(Config{Goos: "linux", Goarch: "amd64"}, []*Lib{lib}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("unexpected removed dirs: %v", removed)
+	}
+
+	removed, err = Clean(Config{}, []*Lib{lib}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != filepath.Join(lib.Path, BuildDirName) {
+		t.Fatalf("unexpected removed dirs: %v", removed)
+	}
+	if _, err := os.Stat(lib.Path); err != nil {
+		t.Fatalf("source dir of local module removed: %v", err)
+	}
+}
+
+func TestBuildBaseDir(t *testing.T) {
+	config := Config{CacheDir: t.TempDir()}
+	lib := &Lib{ModName: "github.com/Foo/bar", Path: "/src/bar", Sum: "h1:1h/a+b="}
+	dir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(config.CacheDir, "github.com", "!foo", "bar", "1h_a-b="); dir != want {
+		t.Fatalf("got %s, want %s", dir, want)
+	}
+	if got := unescapeModulePath("github.com/!foo/bar"); got != lib.ModName {
+		t.Fatalf("unescape: got %s", got)
+	}
+
+	local := &Lib{ModName: "example.com/local", Path: t.TempDir()}
+	if dir, _ := getBuildBaseDir(config, local); dir != local.Path {
+		t.Fatalf("local module built out of tree by default: %s", dir)
+	}
+	config.OutOfTree = true
+	if dir, _ := getBuildBaseDir(config, local); !strings.HasPrefix(dir, config.CacheDir) {
+		t.Fatalf("local module not built out of tree: %s", dir)
+	}
+}
+
+func TestMigrateLegacyBaseDir(t *testing.T) {
+	config := Config{CacheDir: t.TempDir()}
+	lib := &Lib{ModName: "example.com/lib", Sum: "h1:h1/abc="}
+
+	// The old layout trimmed "h1:" as a cutset and kept "/" of the sum
+	legacyDir := filepath.Join(config.CacheDir, "example.com", "lib", "/abc=")
+	if err := os.MkdirAll(filepath.Join(legacyDir, BuildDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLegacyBaseDir(config, lib); err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := getBuildBaseDir(config, lib)
+	if _, err := os.Stat(filepath.Join(dir, BuildDirName)); err != nil {
+		t.Fatalf("build dir not migrated: %v", err)
+	}
+	if _, err := os.Stat(legacyDir); !os.IsNotExist(err) {
+		t.Fatalf("legacy dir left behind: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package clibs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// CgoFlags are the settings for building cgo packages against libs with
+// the standard Go toolchain
+type CgoFlags struct {
+	Goos   string
+	Goarch string
+	CC     string
+	// CFlags and LDFlags are in the order of the libs, dependencies first
+	// for CFlags and last for LDFlags as linkers require
+	CFlags  []string
+	LDFlags []string
+}
+
+// Cgo aggregates the flags of libs, built for the target of config, in
+// the dependency order of ListLibs. Each lib contributes the cflags and
+// libs of its pkgconfig section, or its include dir and static libs, plus
+// the CFLAGS, LDFLAGS, CGO_CFLAGS and CGO_LDFLAGS it exports. CC is the
+// one exported by a lib, $CC, or clang for the target when cross
+// compiling.
+func Cgo(ctx context.Context, config Config, libs []*Lib) (*CgoFlags, error) {
+	config = config.buildDefaults()
+	vars, err := ExportVars(ctx, config, libs)
+	if err != nil {
+		return nil, err
+	}
+	exported := make(map[string]string)
+	for _, v := range vars {
+		exported[v.Key] = v.Value
+	}
+
+	flags := &CgoFlags{Goos: config.Goos, Goarch: config.Goarch}
+	var ldflags [][]string
+	for _, lib := range libs {
+		cflags, libLDFlags, err := lib.cgoFlags()
+		if err != nil {
+			return nil, newError(lib, getTargetTriple(config.Goos, config.Goarch), PhaseExport, err)
+		}
+		flags.CFlags = append(flags.CFlags, cflags...)
+		ldflags = append(ldflags, libLDFlags)
+	}
+	for i := len(ldflags) - 1; i >= 0; i-- {
+		flags.LDFlags = append(flags.LDFlags, ldflags[i]...)
+	}
+	for _, key := range []string{"CFLAGS", "CGO_CFLAGS"} {
+		flags.CFlags = append(flags.CFlags, strings.Fields(exported[key])...)
+	}
+	for _, key := range []string{"LDFLAGS", "CGO_LDFLAGS"} {
+		flags.LDFlags = append(flags.LDFlags, strings.Fields(exported[key])...)
+	}
+
+	flags.CC = exported["CC"]
+	if flags.CC == "" {
+		flags.CC = os.Getenv("CC")
+	}
+	if flags.CC == "" {
+		if config.Goos == runtime.GOOS && config.Goarch == runtime.GOARCH {
+			flags.CC = "cc"
+		} else {
+			flags.CC = "clang --target=" + getTargetTriple(config.Goos, config.Goarch)
+		}
+	}
+	return flags, nil
+}
+
+// cgoFlags returns the flags of lib from its build dir in lib.Env
+func (lib *Lib) cgoFlags() (cflags, ldflags []string, err error) {
+	dir := envValue(lib.Env, EnvBuildDir)
+	if lib.Config.PkgConfig != nil {
+		vars := map[string]string{
+			"prefix":      dir,
+			"exec_prefix": dir,
+			"libdir":      filepath.Join(dir, "lib"),
+			"includedir":  filepath.Join(dir, "include"),
+		}
+		lookup := func(name string) (string, error) {
+			v, ok := vars[name]
+			if !ok {
+				return "", fmt.Errorf("unknown pkg-config variable ${%s}", name)
+			}
+			return v, nil
+		}
+		c, l := lib.Config.pkgConfigFlags()
+		if c, err = expandTemplate(c, lookup); err != nil {
+			return nil, nil, fmt.Errorf("pkgconfig: cflags: %v", err)
+		}
+		if l, err = expandTemplate(l, lookup); err != nil {
+			return nil, nil, fmt.Errorf("pkgconfig: libs: %v", err)
+		}
+		return strings.Fields(c), strings.Fields(l), nil
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "include")); err == nil && info.IsDir() {
+		cflags = append(cflags, "-I"+filepath.Join(dir, "include"))
+	}
+	archives, err := staticArchives(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, archive := range archives {
+		// Only lib<name>.a can be linked with -l<name>
+		if name, ok := strings.CutPrefix(filepath.Base(archive), "lib"); ok {
+			names = append(names, strings.TrimSuffix(name, ".a"))
+		}
+	}
+	if len(names) > 0 {
+		ldflags = append(ldflags, "-L"+filepath.Join(dir, "lib"))
+	}
+	for _, name := range names {
+		ldflags = append(ldflags, "-l"+name)
+	}
+	return cflags, ldflags, nil
+}
+
+// staticArchives returns the static libraries in the lib dir of a build
+// dir, sorted
+func staticArchives(dir string) ([]string, error) {
+	archives, err := filepath.Glob(filepath.Join(dir, "lib", "*.a"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// Vars returns CGO_CFLAGS, CGO_LDFLAGS and CC as export variables
+func (f *CgoFlags) Vars(libs []*Lib) []ExportVar {
+	var mods []string
+	for _, lib := range libs {
+		mods = append(mods, lib.ModName)
+	}
+	return []ExportVar{
+		{Key: "CGO_CFLAGS", Value: strings.Join(f.CFlags, " "), Libs: mods},
+		{Key: "CGO_LDFLAGS", Value: strings.Join(f.LDFlags, " "), Libs: mods},
+		{Key: "CC", Value: f.CC, Libs: mods},
+	}
+}
+
+// CgoFileName is the file written by WriteFile for go generate
+const CgoFileName = "zz_clibs_cgo.go"
+
+// WriteFile writes a Go file of package pkg with #cgo directives for the
+// flags, constrained to their target. CC can not be set by directives and
+// is left to the environment.
+func (f *CgoFlags) WriteFile(path, pkg string) error {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by llgo_clibs export -cgo-file; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "//go:build %s && %s\n\n", f.Goos, f.Goarch)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	if len(f.CFlags) > 0 {
+		fmt.Fprintf(&b, "// #cgo CFLAGS: %s\n", cgoQuote(f.CFlags))
+	}
+	if len(f.LDFlags) > 0 {
+		fmt.Fprintf(&b, "// #cgo LDFLAGS: %s\n", cgoQuote(f.LDFlags))
+	}
+	b.WriteString("import \"C\"\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, src, 0644)
+}
+
+// cgoQuote joins args for a #cgo directive, quoting those with spaces
+func cgoQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " \t'\"") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `\'`) + "'"
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,86 @@
+package clibs
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCgo(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc not found")
+	}
+	config := Config{Logger: Discard}
+	base := &Lib{
+		ModName: "example.com/base",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name: "base",
+			Build: &BuildSpec{Command: `
+mkdir -p "$CLIBS_BUILD_DIR/include" "$CLIBS_BUILD_DIR/lib"
+echo 'int base(void);' > "$CLIBS_BUILD_DIR/include/base.h"
+echo 'int base(void) { return 40; }' > base.c
+cc -c base.c -o base.o && ar rcs "$CLIBS_BUILD_DIR/lib/libbase.a" base.o`},
+		},
+	}
+	top := &Lib{
+		ModName: "example.com/top",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name: "top",
+			Build: &BuildSpec{Command: `
+mkdir -p "$CLIBS_BUILD_DIR/include" "$CLIBS_BUILD_DIR/lib"
+echo 'int top(void);' > "$CLIBS_BUILD_DIR/include/top.h"
+printf 'int base(void);\nint top(void) { return base() + 2; }\n' > top.c
+cc -c top.c -o top.o && ar rcs "$CLIBS_BUILD_DIR/lib/libtop.a" top.o`},
+			PkgConfig: &PkgConfigSpec{Cflags: "-I${includedir} -DTOP"},
+			Export:    `echo LDFLAGS=-lm`,
+		},
+	}
+	// Dependencies first, as listed by ListLibs
+	libs := []*Lib{base, top}
+	if err := Build(config, libs); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := Cgo(context.Background(), config, libs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := getTargetTriple(runtime.GOOS, runtime.GOARCH)
+	baseDir := filepath.Join(base.Path, BuildDirName, target)
+	topDir := filepath.Join(top.Path, BuildDirName, target)
+	wantCFlags := []string{"-I" + baseDir + "/include", "-I" + topDir + "/include", "-DTOP"}
+	wantLDFlags := []string{"-L" + topDir + "/lib", "-ltop", "-L" + baseDir + "/lib", "-lbase", "-lm"}
+	if !reflect.DeepEqual(flags.CFlags, wantCFlags) {
+		t.Errorf("CFlags = %q, want %q", flags.CFlags, wantCFlags)
+	}
+	if !reflect.DeepEqual(flags.LDFlags, wantLDFlags) {
+		t.Errorf("LDFlags = %q, want %q", flags.LDFlags, wantLDFlags)
+	}
+
+	// The generated file builds a cgo program with the standard toolchain
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/cgoapp\n\ngo 1.21\n",
+		"main.go": "package main\n\n// #include <top.h>\nimport \"C\"\n\nfunc main() { println(C.top()) }\n",
+	}
+	writeTestFiles(t, dir, files)
+	if err := flags.WriteFile(filepath.Join(dir, CgoFileName), "main"); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=1", "CC="+flags.CC)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %v\n%s", err, output)
+	}
+	if strings.TrimSpace(string(output)) != "42" {
+		t.Fatalf("unexpected output %q", output)
+	}
+}
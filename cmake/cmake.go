@@ -162,7 +162,7 @@ func (c *Config) Build() string {
 	// Set build type if not already defined
 	profile := c.profile
 	if profile == "" {
-		profile = "Release"
+		profile = buildTypeFromEnv()
 	}
 
 	if !c.isDefined("CMAKE_BUILD_TYPE") {
@@ -226,3 +226,17 @@ func (c *Config) isDefined(name string) bool {
 	}
 	return false
 }
+
+// buildTypeFromEnv maps the clibs build profile to a CMake build type.
+// The variable is clibs.EnvBuildProfile, not imported to keep this package
+// free of the root one.
+func buildTypeFromEnv() string {
+	switch os.Getenv("CLIBS_BUILD_PROFILE") {
+	case "debug":
+		return "Debug"
+	case "asan", "ubsan":
+		return "RelWithDebInfo"
+	default:
+		return "Release"
+	}
+}
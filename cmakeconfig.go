@@ -0,0 +1,137 @@
+package clibs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteCMakeConfigs writes a CMake package config for every lib into
+// prefix, so C projects can find_package(<name> CONFIG) with prefix in
+// CMAKE_PREFIX_PATH and link the imported target clibs::<name>. The
+// configs point at the build or prebuilt dirs of the target of config,
+// which must have been built. Libs required through their pkgconfig
+// section become dependencies. It returns the absolute prefix.
+func WriteCMakeConfigs(ctx context.Context, config Config, libs []*Lib, prefix string) (string, error) {
+	config = config.buildDefaults()
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	prefix, err := filepath.Abs(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	// pkg-config names of the libs, to resolve requires
+	names := make(map[string]string)
+	for _, lib := range libs {
+		names[lib.Config.Name] = lib.Config.Name
+		if lib.Config.PkgConfig != nil {
+			names[lib.Config.pkgConfigName()] = lib.Config.Name
+		}
+	}
+
+	for _, lib := range libs {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := lib.resolveEnv(config); err != nil {
+			return "", newError(lib, targetTriple, PhaseExport, err)
+		}
+		dir := envValue(lib.Env, EnvBuildDir)
+		var deps []string
+		if lib.Config.PkgConfig != nil {
+			for _, req := range lib.Config.PkgConfig.Requires {
+				// Strip version constraints like "foo >= 1.0"
+				fields := strings.Fields(req)
+				if len(fields) == 0 {
+					continue
+				}
+				req = fields[0]
+				if name, ok := names[req]; ok {
+					deps = append(deps, name)
+				} else {
+					config.libLogger(lib).warnf("%s is not a clibs lib, not added to the CMake config", req)
+				}
+			}
+		}
+		if err := writeCMakeConfig(prefix, lib, targetTriple, dir, deps); err != nil {
+			return "", newError(lib, targetTriple, PhaseExport, err)
+		}
+	}
+	return prefix, nil
+}
+
+// writeCMakeConfig writes <name>Config.cmake and <name>ConfigVersion.cmake
+// of lib built into dir
+func writeCMakeConfig(prefix string, lib *Lib, targetTriple, dir string, deps []string) error {
+	name := lib.Config.Name
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	var includes []string
+	if info, err := os.Stat(filepath.Join(dir, "include")); err == nil && info.IsDir() {
+		includes = append(includes, filepath.ToSlash(filepath.Join(dir, "include")))
+	}
+	archives, err := staticArchives(dir)
+	if err != nil {
+		return err
+	}
+	var links []string
+	for _, archive := range archives {
+		links = append(links, filepath.ToSlash(archive))
+	}
+	for _, dep := range deps {
+		links = append(links, "clibs::"+dep)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by llgo_clibs for %s (%s)\n", lib.ModName, targetTriple)
+	if len(deps) > 0 {
+		b.WriteString("include(CMakeFindDependencyMacro)\n")
+		for _, dep := range deps {
+			fmt.Fprintf(&b, "find_dependency(%s CONFIG)\n", dep)
+		}
+	}
+	fmt.Fprintf(&b, "if(NOT TARGET clibs::%s)\n", name)
+	fmt.Fprintf(&b, "  add_library(clibs::%s INTERFACE IMPORTED)\n", name)
+	if len(includes) > 0 || len(links) > 0 {
+		fmt.Fprintf(&b, "  set_target_properties(clibs::%s PROPERTIES\n", name)
+		if len(includes) > 0 {
+			fmt.Fprintf(&b, "    INTERFACE_INCLUDE_DIRECTORIES %s\n", cmakeQuote(strings.Join(includes, ";")))
+		}
+		if len(links) > 0 {
+			fmt.Fprintf(&b, "    INTERFACE_LINK_LIBRARIES %s\n", cmakeQuote(strings.Join(links, ";")))
+		}
+		b.WriteString("  )\n")
+	}
+	b.WriteString("endif()\n")
+
+	version := strings.TrimPrefix(lib.Config.Version, "v")
+	var v strings.Builder
+	fmt.Fprintf(&v, "set(PACKAGE_VERSION %s)\n", cmakeQuote(version))
+	v.WriteString("if(PACKAGE_FIND_VERSION AND PACKAGE_VERSION VERSION_LESS PACKAGE_FIND_VERSION)\n")
+	v.WriteString("  set(PACKAGE_VERSION_COMPATIBLE FALSE)\n")
+	v.WriteString("else()\n")
+	v.WriteString("  set(PACKAGE_VERSION_COMPATIBLE TRUE)\n")
+	v.WriteString("  if(PACKAGE_FIND_VERSION STREQUAL PACKAGE_VERSION)\n")
+	v.WriteString("    set(PACKAGE_VERSION_EXACT TRUE)\n")
+	v.WriteString("  endif()\n")
+	v.WriteString("endif()\n")
+
+	cmakeDir := filepath.Join(prefix, "lib", "cmake", name)
+	if err := os.MkdirAll(cmakeDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(cmakeDir, name+"Config.cmake"), []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cmakeDir, name+"ConfigVersion.cmake"), []byte(v.String()), 0644)
+}
+
+// cmakeQuote quotes s as a CMake argument
+func cmakeQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`)
+	return `"` + r.Replace(s) + `"`
+}
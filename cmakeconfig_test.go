@@ -0,0 +1,67 @@
+package clibs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCMakeConfigs(t *testing.T) {
+	config := Config{Goos: "linux", Goarch: "amd64", Logger: Discard}
+	install := `mkdir -p "$CLIBS_BUILD_DIR/include" "$CLIBS_BUILD_DIR/lib" && touch "$CLIBS_BUILD_DIR/lib/lib$NAME.a"`
+	base := &Lib{
+		ModName: "example.com/base",
+		Path:    t.TempDir(),
+		Config:  LibSpec{Name: "base", Version: "v1.2.0", Build: &BuildSpec{Command: "NAME=base; " + install}},
+	}
+	top := &Lib{
+		ModName: "example.com/top",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:      "top",
+			Version:   "2.0",
+			Build:     &BuildSpec{Command: "NAME=top; " + install},
+			PkgConfig: &PkgConfigSpec{Requires: []string{"base >= 1.0", "zlib"}},
+		},
+	}
+	libs := []*Lib{base, top}
+	prefix := t.TempDir()
+	if _, err := WriteCMakeConfigs(context.Background(), config, libs, prefix); !errors.Is(err, ErrNotBuilt) {
+		t.Fatalf("configs written for unbuilt libs: %v", err)
+	}
+	if err := Build(config, libs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteCMakeConfigs(context.Background(), config, libs, prefix); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(prefix, "lib", "cmake", "top", "topConfig.cmake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topDir := filepath.Join(top.Path, BuildDirName, "x86_64-unknown-linux")
+	for _, want := range []string{
+		"find_dependency(base CONFIG)\n",
+		"add_library(clibs::top INTERFACE IMPORTED)\n",
+		`INTERFACE_INCLUDE_DIRECTORIES "` + topDir + `/include"`,
+		`INTERFACE_LINK_LIBRARIES "` + topDir + `/lib/libtop.a;clibs::base"`,
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("topConfig.cmake has no %q:\n%s", want, content)
+		}
+	}
+	if strings.Contains(string(content), "zlib") {
+		t.Errorf("non-clibs requirement added:\n%s", content)
+	}
+	version, err := os.ReadFile(filepath.Join(prefix, "lib", "cmake", "base", "baseConfigVersion.cmake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(version), `set(PACKAGE_VERSION "1.2.0")`) {
+		t.Errorf("unexpected version file:\n%s", version)
+	}
+}
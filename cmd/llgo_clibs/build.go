@@ -1,50 +1,188 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
-	"runtime"
+	"text/tabwriter"
+	"time"
 
 	"github.com/cpunion/clibs"
 )
 
+// buildOptions 是 build 命令的标志
+type buildOptions struct {
+	force      bool
+	prebuilt   bool
+	dryRun     bool
+	compdb     bool
+	requireSig bool
+	requireSum bool
+	format     string
+	tags       string
+	targets    string
+	profile    string
+	policy     string
+	timeout    time.Duration
+}
+
 // runBuild 执行 build 命令
-func runBuild(force, prebuilt bool, tags string, args []string) {
-	goos := os.Getenv("GOOS")
-	goarch := os.Getenv("GOARCH")
-	if goos == "" {
-		goos = runtime.GOOS
+func runBuild(ctx context.Context, logger clibs.Logger, opts buildOptions, args []string) {
+	goos, goarch := envTarget()
+
+	jsonOutput, err := parseOutputFormat(opts.format)
+	if err != nil {
+		fatalf(logger, "%v", err)
 	}
-	if goarch == "" {
-		goarch = runtime.GOARCH
+
+	buildProfile, err := clibs.ParseProfile(opts.profile)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	prebuiltPolicy, err := clibs.ParsePrebuiltPolicy(opts.policy)
+	if err != nil {
+		fatalf(logger, "%v", err)
 	}
 
-	fmt.Printf("Build: GOOS: %s, GOARCH: %s, Force: %v, Prebuilt: %v, Tags: %v\n",
-		goos, goarch, force, prebuilt, tags)
+	logf(logger, clibs.LevelDebug, "Build: GOOS: %s, GOARCH: %s, Profile: %s, Force: %v, Prebuilt: %v, Policy: %s, Tags: %v",
+		goos, goarch, buildProfile, opts.force, opts.prebuilt, prebuiltPolicy, opts.tags)
 
-	// 准备 tags 参数，使用 Go 标准格式
-	var tagArgs []string
-	if tags != "" {
-		tagArgs = []string{"-tags", tags}
+	buildConfig := clibs.Config{
+		Goos:             goos,
+		Goarch:           goarch,
+		Profile:          buildProfile,
+		Force:            opts.force,
+		Prebuilt:         opts.prebuilt,
+		PrebuiltPolicy:   prebuiltPolicy,
+		CompileCommands:  opts.compdb,
+		RequireSignature: opts.requireSig,
+		RequireChecksum:  opts.requireSum,
+		Tags:             tagArgs(opts.tags),
+		StepTimeout:      opts.timeout,
+		Logger:           logger,
+	}
+
+	if opts.targets != "" {
+		if buildConfig.Targets, err = clibs.ParseTargets(opts.targets); err != nil {
+			fatalf(logger, "%v", err)
+		}
 	}
 
-	libs, err := clibs.ListLibs(tagArgs, args...)
+	libs, err := clibs.ListLibsContext(ctx, buildConfig, args...)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting C library libs: %v\n", err)
-		os.Exit(1)
+		fatalf(logger, "Error getting C library libs: %v", err)
 	}
 
-	buildConfig := clibs.Config{
-		Goos:     goos,
-		Goarch:   goarch,
-		Force:    force,
-		Prebuilt: prebuilt,
-		Tags:     tagArgs,
+	if opts.dryRun && len(buildConfig.Targets) > 0 {
+		// 逐个目标生成构建计划
+		var items []clibs.PlanItem
+		for _, target := range buildConfig.Targets {
+			targetConfig := buildConfig
+			targetConfig.Goos, targetConfig.Goarch = target.Goos, target.Goarch
+			targetItems, err := clibs.PlanContext(ctx, targetConfig, libs)
+			if err != nil {
+				fatalf(logger, "%v", err)
+			}
+			items = append(items, targetItems...)
+		}
+		printPlan(logger, items, jsonOutput)
+		return
+	}
+	if opts.dryRun {
+		items, err := clibs.PlanContext(ctx, buildConfig, libs)
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+		printPlan(logger, items, jsonOutput)
+		return
+	}
+
+	if len(buildConfig.Targets) > 0 {
+		results := clibs.BuildTargets(ctx, buildConfig, libs)
+		if failed := printMatrix(libs, buildConfig.Targets, results); failed > 0 {
+			fatalf(logger, "%d of %d builds failed", failed, len(results))
+		}
+		return
 	}
 
-	err = clibs.Build(buildConfig, libs)
+	err = clibs.BuildContext(ctx, buildConfig, libs)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		fatalf(logger, "%v", err)
+	}
+	logf(logger, clibs.LevelInfo, "%d C libraries ready", len(libs))
+}
+
+// parseOutputFormat 解析 -format 标志，返回是否输出 JSON
+func parseOutputFormat(format string) (jsonOutput bool, err error) {
+	switch format {
+	case "text":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid format %q, want text or json", format)
+}
+
+// printPlan 输出构建计划
+func printPlan(logger clibs.Logger, items []clibs.PlanItem, jsonOutput bool) {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		for _, item := range items {
+			if err := enc.Encode(item); err != nil {
+				fatalf(logger, "%v", err)
+			}
+		}
+		return
+	}
+	for _, item := range items {
+		fmt.Printf("%s [%s]: %s\n", item.Lib, item.Target, item.Action)
+		printPlanDetails(item, "    ")
+		if item.Fallback != nil {
+			fmt.Printf("    fallback: %s\n", item.Fallback.Action)
+			printPlanDetails(*item.Fallback, "        ")
+		}
+	}
+}
+
+func printPlanDetails(item clibs.PlanItem, indent string) {
+	fmt.Printf("%sdir: %s\n", indent, item.Dir)
+	fmt.Printf("%sreason: %s\n", indent, item.Reason)
+	for _, d := range item.Diff {
+		fmt.Printf("%s  %s\n", indent, d)
+	}
+}
+
+// printMatrix 以库 × 目标的表格输出构建结果，并返回失败的数量
+func printMatrix(libs []*clibs.Lib, targets []clibs.Target, results []clibs.BuildResult) (failed int) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "LIB")
+	for _, target := range targets {
+		fmt.Fprintf(w, "\t%s", target)
+	}
+	fmt.Fprintln(w)
+
+	var errs []error
+	for i, lib := range libs {
+		fmt.Fprint(w, lib.Config.Name)
+		for _, result := range results[i*len(targets) : (i+1)*len(targets)] {
+			cell := "ok"
+			if result.Err != nil {
+				cell = "FAILED"
+				errs = append(errs, result.Err)
+			} else if result.Prebuilt() {
+				cell = "prebuilt"
+			}
+			fmt.Fprintf(w, "\t%s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	// 失败详情附在表格之后
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "\n%v\n", err)
 	}
+	return len(errs)
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cpunion/clibs"
+)
+
+// runCache 执行 cache 命令及其子命令
+func runCache(ctx context.Context, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Expected 'prune' or 'du' cache subcommands")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "prune":
+		pruneCmd := flag.NewFlagSet("cache prune", flag.ExitOnError)
+		projects := pruneCmd.String("projects", "", "A comma-separated list of project dirs, removes entries none of them use")
+		tags := pruneCmd.String("tags", "", "A comma-separated list of build tags used to list project libs")
+		unusedDays := pruneCmd.Int("unused-days", 0, "Remove entries not used for this many days, 0 disables")
+		maxSize := pruneCmd.String("max-size", "", "Remove least recently used entries until the cache fits, e.g. 10G")
+		dryRun := pruneCmd.Bool("n", false, "Print what would be removed without removing it")
+		pruneLog := addLogFlags(pruneCmd)
+		pruneCmd.Parse(args[1:])
+		runCachePrune(ctx, pruneLog.logger(), *projects, *tags, *unusedDays, *maxSize, *dryRun)
+	case "du":
+		duCmd := flag.NewFlagSet("cache du", flag.ExitOnError)
+		duLog := addLogFlags(duCmd)
+		duCmd.Parse(args[1:])
+		runCacheDu(duLog.logger())
+	default:
+		fmt.Printf("%s is not a valid cache command.\n", args[0])
+		fmt.Println("Expected 'prune' or 'du' cache subcommands")
+		os.Exit(1)
+	}
+}
+
+// runCachePrune 执行 cache prune 命令
+func runCachePrune(ctx context.Context, logger clibs.Logger, projects, tags string, unusedDays int, maxSize string, dryRun bool) {
+	var opts clibs.PruneOptions
+	opts.DryRun = dryRun
+	if unusedDays > 0 {
+		opts.UnusedFor = time.Duration(unusedDays) * 24 * time.Hour
+	}
+	if maxSize != "" {
+		size, err := parseSize(maxSize)
+		if err != nil {
+			fatalf(logger, "invalid -max-size: %v", err)
+		}
+		opts.MaxSize = size
+	}
+
+	// 收集项目引用的缓存目录
+	if projects != "" {
+		opts.Keep = []*clibs.Lib{}
+		for _, project := range strings.Split(projects, ",") {
+			dir, err := filepath.Abs(strings.TrimSpace(project))
+			if err != nil {
+				fatalf(logger, "%v", err)
+			}
+			libs, err := clibs.ListLibsContext(ctx, clibs.Config{Dir: dir, Tags: tagArgs(tags), Logger: logger}, "./...")
+			if err != nil {
+				fatalf(logger, "Error getting C library libs of %s: %v", dir, err)
+			}
+			opts.Keep = append(opts.Keep, libs...)
+		}
+	}
+
+	if opts.Keep == nil && opts.UnusedFor == 0 && opts.MaxSize == 0 {
+		fatalf(logger, "cache prune needs at least one of -projects, -unused-days or -max-size")
+	}
+
+	removed, err := clibs.PruneCache(clibs.Config{}, opts)
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	var freed int64
+	for _, entry := range removed {
+		freed += entry.Size
+		fmt.Printf("%s %s (%s, last used %s)\n", verb, entryName(entry), formatSize(entry.Size), formatLastUse(entry.LastUse))
+	}
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	fmt.Printf("%s %d entries, %s\n", verb, len(removed), formatSize(freed))
+}
+
+// runCacheDu 执行 cache du 命令
+func runCacheDu(logger clibs.Logger) {
+	entries, err := clibs.CacheEntries(clibs.Config{})
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	if len(entries) == 0 {
+		fmt.Println("Build cache is empty.")
+		return
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		total += entry.Size
+		fmt.Fprintf(w, "%s\t%s\t%s\n", formatSize(entry.Size), entryName(entry), formatLastUse(entry.LastUse))
+	}
+	fmt.Fprintf(w, "%s\ttotal (%d entries)\t\n", formatSize(total), len(entries))
+	w.Flush()
+}
+
+// entryName 返回缓存条目的显示名称
+func entryName(entry clibs.CacheEntry) string {
+	if entry.Store {
+		return clibs.StoreDirName + "/" + entry.Key
+	}
+	if entry.List {
+		return clibs.ListCacheDirName + "/" + entry.Key
+	}
+	return entry.Module + "@" + entry.Key
+}
+
+// parseSize 解析 10G、500M、1024 这样的字节数
+func parseSize(s string) (int64, error) {
+	orig := s
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", orig)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// formatLastUse 格式化最后使用时间
+func formatLastUse(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cpunion/clibs"
+)
+
+// runClean 执行 clean 命令
+func runClean(ctx context.Context, logger clibs.Logger, tags, target string, args []string) {
+	goos, goarch := envTarget()
+	config := clibs.Config{
+		Goos:   goos,
+		Goarch: goarch,
+		Tags:   tagArgs(tags),
+		Logger: logger,
+	}
+	allTargets := target == ""
+	if !allTargets {
+		targets, err := clibs.ParseTargets(target)
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+		if len(targets) != 1 {
+			fatalf(logger, "-target takes a single GOOS/GOARCH target")
+		}
+		config.Goos, config.Goarch = targets[0].Goos, targets[0].Goarch
+	}
+
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	removed, err := clibs.Clean(config, libs, allTargets)
+	for _, dir := range removed {
+		fmt.Printf("removed %s\n", dir)
+	}
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	if len(removed) == 0 {
+		fmt.Println("Nothing to clean.")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cpunion/clibs"
+)
+
+// runCompdb 合并各库构建时记录的 compile_commands.json
+func runCompdb(ctx context.Context, logger clibs.Logger, tags, profile, out string, args []string) {
+	buildProfile, err := clibs.ParseProfile(profile)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	goos, goarch := envTarget()
+	config := clibs.Config{
+		Goos:    goos,
+		Goarch:  goarch,
+		Profile: buildProfile,
+		Tags:    tagArgs(tags),
+		Logger:  logger,
+	}
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	commands, err := clibs.MergeCompileCommands(config, libs, out)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "%d compile commands of %d C libraries written to %s\n", len(commands), len(libs), out)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// envOr 返回环境变量的值，未设置时返回默认值
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envTarget 返回 $GOOS/$GOARCH，未设置时为当前平台
+func envTarget() (goos, goarch string) {
+	return envOr("GOOS", runtime.GOOS), envOr("GOARCH", runtime.GOARCH)
+}
+
+// tagArgs 把 -tags 标志转换为 go list 参数，使用 Go 标准格式
+func tagArgs(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return []string{"-tags", tags}
+}
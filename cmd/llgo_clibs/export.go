@@ -1,54 +1,132 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"go/parser"
+	"go/token"
 	"os"
-	"runtime"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/cpunion/clibs"
 )
 
+// exportOptions 是 export 命令的标志
+type exportOptions struct {
+	prebuilt    bool
+	build       bool
+	tags        string
+	profile     string
+	format      string
+	cmakePrefix string
+	cgo         bool
+	cgoFile     string
+	timeout     time.Duration
+}
+
 // runExport 执行 export 命令
-func runExport(prebuilt bool, tags string, args []string) {
-	goos := os.Getenv("GOOS")
-	goarch := os.Getenv("GOARCH")
-	if goos == "" {
-		goos = runtime.GOOS
+func runExport(ctx context.Context, logger clibs.Logger, opts exportOptions, args []string) {
+	goos, goarch := envTarget()
+
+	// -cgo/-cgo-file 和 -cmake 各自输出不同内容，不能同时使用
+	if (opts.cgo || opts.cgoFile != "") && opts.cmakePrefix != "" {
+		fatalf(logger, "-cmake cannot be used with -cgo or -cgo-file")
+	}
+
+	buildProfile, err := clibs.ParseProfile(opts.profile)
+	if err != nil {
+		fatalf(logger, "%v", err)
 	}
-	if goarch == "" {
-		goarch = runtime.GOARCH
+
+	// raw 原样输出导出脚本的每一行
+	var exportFormat clibs.ExportFormat
+	if opts.format != "raw" {
+		if exportFormat, err = clibs.ParseExportFormat(opts.format); err != nil {
+			fatalf(logger, "%v", err)
+		}
 	}
 
-	fmt.Printf("Export: GOOS: %s, GOARCH: %s, Prebuilt: %v, Tags: %v\n",
-		goos, goarch, prebuilt, tags)
+	logf(logger, clibs.LevelDebug, "Export: GOOS: %s, GOARCH: %s, Profile: %s, Prebuilt: %v, Build: %v, Tags: %v",
+		goos, goarch, buildProfile, opts.prebuilt, opts.build, opts.tags)
 
-	// 准备 tags 参数，使用 Go 标准格式
-	var tagArgs []string
-	if tags != "" {
-		tagArgs = []string{"-tags", tags}
+	buildConfig := clibs.Config{
+		Goos:        goos,
+		Goarch:      goarch,
+		Profile:     buildProfile,
+		Prebuilt:    opts.prebuilt,
+		Tags:        tagArgs(opts.tags),
+		StepTimeout: opts.timeout,
+		Logger:      logger,
 	}
 
-	libs, err := clibs.ListLibs(tagArgs, args...)
+	libs, err := clibs.ListLibsContext(ctx, buildConfig, args...)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting C library libs: %v\n", err)
-		os.Exit(1)
+		fatalf(logger, "Error getting C library libs: %v", err)
 	}
 
-	buildConfig := clibs.Config{
-		Goos:     goos,
-		Goarch:   goarch,
-		Prebuilt: prebuilt,
-		Tags:     tagArgs,
+	// 按需构建：已构建的库直接复用，导出脚本使用与构建相同的环境
+	if opts.build {
+		if err := clibs.BuildContext(ctx, buildConfig, libs); err != nil {
+			fatalf(logger, "%v", err)
+		}
+	}
+
+	if opts.cgo || opts.cgoFile != "" {
+		flags, err := clibs.Cgo(ctx, buildConfig, libs)
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+		if opts.cgoFile != "" {
+			pkg, err := goPackageName(filepath.Dir(opts.cgoFile))
+			if err != nil {
+				fatalf(logger, "%v", err)
+			}
+			if err := flags.WriteFile(opts.cgoFile, pkg); err != nil {
+				fatalf(logger, "%v", err)
+			}
+			logf(logger, clibs.LevelInfo, "wrote %s", opts.cgoFile)
+		}
+		if opts.cgo {
+			printVars(logger, exportFormat, flags.Vars(libs))
+		}
+		return
+	}
+
+	if opts.cmakePrefix != "" {
+		prefix, err := clibs.WriteCMakeConfigs(ctx, buildConfig, libs, opts.cmakePrefix)
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+		// 只输出 CMAKE_PREFIX_PATH，格式与 -format 一致
+		vars := []clibs.ExportVar{{Key: "CMAKE_PREFIX_PATH", Value: prefix}}
+		for _, lib := range libs {
+			vars[0].Libs = append(vars[0].Libs, lib.ModName)
+		}
+		printVars(logger, exportFormat, vars)
+		return
 	}
 
-	exports, err := clibs.Export(buildConfig, libs)
+	if exportFormat != "" {
+		vars, err := clibs.ExportVars(ctx, buildConfig, libs)
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+		if err := clibs.WriteExports(os.Stdout, exportFormat, vars); err != nil {
+			fatalf(logger, "%v", err)
+		}
+		return
+	}
+
+	exports, err := clibs.ExportContext(ctx, buildConfig, libs)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		fatalf(logger, "%v", err)
 	}
 
+	// 诊断信息输出到 stderr，stdout 只有导出的变量
 	if len(exports) == 0 {
-		fmt.Println("No exports found.")
+		logf(logger, clibs.LevelInfo, "No exports found.")
 		return
 	}
 
@@ -57,3 +135,38 @@ func runExport(prebuilt bool, tags string, args []string) {
 		fmt.Printf("%s\n", export)
 	}
 }
+
+// printVars 按格式输出变量，raw 格式输出 KEY=VALUE
+func printVars(logger clibs.Logger, format clibs.ExportFormat, vars []clibs.ExportVar) {
+	if format == "" {
+		for _, v := range vars {
+			fmt.Printf("%s=%s\n", v.Key, v.Value)
+		}
+		return
+	}
+	if err := clibs.WriteExports(os.Stdout, format, vars); err != nil {
+		fatalf(logger, "%v", err)
+	}
+}
+
+// goPackageName 返回 dir 中 Go 包的名字，go generate 时使用 $GOPACKAGE
+func goPackageName(dir string) (string, error) {
+	if pkg := os.Getenv("GOPACKAGE"); pkg != "" {
+		return pkg, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || filepath.Base(file) == clibs.CgoFileName {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return "", err
+		}
+		return f.Name.Name, nil
+	}
+	return "", fmt.Errorf("no Go files in %s to take the package name from, set $GOPACKAGE", dir)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cpunion/clibs"
+)
+
+// runFlags 展开各包的 LLGoPackage 和 LLGoFiles，输出目标平台最终的编译和链接参数
+func runFlags(ctx context.Context, logger clibs.Logger, format, tags, profile string, timeout time.Duration, args []string) {
+	jsonOutput, err := parseOutputFormat(format)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	buildProfile, err := clibs.ParseProfile(profile)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	goos, goarch := envTarget()
+	config := clibs.Config{
+		Goos:        goos,
+		Goarch:      goarch,
+		Profile:     buildProfile,
+		Tags:        tagArgs(tags),
+		StepTimeout: timeout,
+		Logger:      logger,
+	}
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	flags, err := clibs.LLGo(ctx, config, libs, args...)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(flags); err != nil {
+			fatalf(logger, "%v", err)
+		}
+		return
+	}
+	for _, pkg := range flags.Packages {
+		logf(logger, clibs.LevelDebug, "%s: LLGoPackage %q => %s", pkg.ImportPath, pkg.LLGoPackage, strings.Join(pkg.LDFlags, " "))
+		if pkg.LLGoFiles != "" {
+			logf(logger, clibs.LevelDebug, "%s: LLGoFiles %q => %s", pkg.ImportPath, pkg.LLGoFiles, strings.Join(pkg.CFlags, " "))
+		}
+	}
+	fmt.Printf("cflags: %s\n", strings.Join(flags.CFlags, " "))
+	fmt.Printf("ldflags: %s\n", strings.Join(flags.LDFlags, " "))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cpunion/clibs"
+	"gopkg.in/yaml.v3"
+)
+
+// runInfo 执行 info 命令
+func runInfo(ctx context.Context, logger clibs.Logger, tags, profile string, args []string) {
+	if len(args) == 0 {
+		fatalf(logger, "usage: llgo_clibs info [flags] <module> [packages]")
+	}
+	module, patterns := args[0], args[1:]
+
+	buildProfile, err := clibs.ParseProfile(profile)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	goos, goarch := envTarget()
+	config := clibs.Config{
+		Goos:    goos,
+		Goarch:  goarch,
+		Profile: buildProfile,
+		Tags:    tagArgs(tags),
+		Logger:  logger,
+	}
+
+	libs, err := clibs.ListLibsContext(ctx, config, patterns...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	var lib *clibs.Lib
+	for _, l := range libs {
+		if l.ModName == module || l.Config.Name == module {
+			lib = l
+			break
+		}
+	}
+	if lib == nil {
+		fatalf(logger, "%s is not a C library of the current project", module)
+	}
+
+	info, err := lib.Info(ctx, config)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	fmt.Printf("Module: %s\n", lib.ModName)
+	fmt.Printf("Path: %s\n", lib.Path)
+	fmt.Printf("Sum: %s\n", lib.Sum)
+	fmt.Printf("Build dir: %s", info.BuildDir)
+	if !info.Built {
+		fmt.Printf(" (not built)")
+	}
+	fmt.Println()
+
+	fmt.Println("\nSpec:")
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(lib.Config); err != nil {
+		fatalf(logger, "%v", err)
+	}
+	enc.Close()
+
+	fmt.Println("\nEnv:")
+	for _, env := range info.Env {
+		fmt.Printf("  %s\n", env)
+	}
+
+	fmt.Println("\nExports:")
+	if !info.Built {
+		fmt.Println("  (run llgo_clibs build first)")
+	}
+	for _, export := range info.Exports {
+		fmt.Printf("  %s\n", export)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cpunion/clibs"
+)
+
+// runKeygen 生成签名密钥对：<prefix>.key 为私钥，<prefix>.pub 为公钥
+func runKeygen(logger clibs.Logger, args []string) {
+	if len(args) != 1 {
+		fatalf(logger, "usage: keygen <prefix>")
+	}
+	prefix := args[0]
+
+	private, public, err := clibs.GenerateKey()
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	// 不覆盖已有的密钥文件
+	if err := writeNewFile(prefix+".key", private, 0600); err != nil {
+		fatalf(logger, "%v", err)
+	}
+	if err := writeNewFile(prefix+".pub", []byte(public+" "+prefix+"\n"), 0644); err != nil {
+		// 没有公钥的私钥无法使用
+		os.Remove(prefix + ".key")
+		fatalf(logger, "%v", err)
+	}
+	fmt.Printf("Private key: %s.key\n", prefix)
+	fmt.Printf("Public key:  %s.pub\n", prefix)
+	fmt.Printf("Add the public key to %s or ~/.llgo/clibs_trusted_keys to trust it:\n%s\n", clibs.ProjectKeysFile, public)
+}
+
+// writeNewFile 创建不存在的文件并写入内容，失败时删除写了一半的文件
+func writeNewFile(path string, content []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
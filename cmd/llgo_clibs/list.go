@@ -1,25 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
 
 	"github.com/cpunion/clibs"
 )
 
 // runList 执行 list 命令
-func runList(tags string, args []string) {
-	// 准备 tags 参数，使用 Go 标准格式
-	var tagArgs []string
-	if tags != "" {
-		tagArgs = []string{"-tags", tags}
-	}
-
+func runList(ctx context.Context, logger clibs.Logger, tags string, args []string) {
 	// Get libs from specified libs or all libs if none specified
-	libs, err := clibs.ListLibs(tagArgs, args...)
+	libs, err := clibs.ListLibsContext(ctx, clibs.Config{Tags: tagArgs(tags), Logger: logger}, args...)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error listing C libraries: %v\n", err)
-		os.Exit(1)
+		fatalf(logger, "Error listing C libraries: %v", err)
 	}
 
 	// Display the results
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cpunion/clibs"
+)
+
+// logFlags 是所有子命令共用的日志标志
+type logFlags struct {
+	verbose *bool
+	quiet   *bool
+	json    *bool
+}
+
+// addLogFlags 为子命令注册 -v、-q 和 -json 标志
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		verbose: fs.Bool("v", false, "Verbose output, including build command output"),
+		quiet:   fs.Bool("q", false, "Only print warnings and errors"),
+		json:    fs.Bool("json", false, "Print log events as JSON lines to stderr"),
+	}
+}
+
+// logger 根据标志创建 Logger
+func (f *logFlags) logger() clibs.Logger {
+	level := clibs.LevelInfo
+	if *f.verbose {
+		level = clibs.LevelDebug
+	} else if *f.quiet {
+		level = clibs.LevelWarn
+	}
+	if *f.json {
+		return clibs.NewJSONLogger(os.Stderr, level)
+	}
+	return clibs.NewTextLogger(os.Stderr, level)
+}
+
+// logf 输出一条日志
+func logf(logger clibs.Logger, level clibs.Level, format string, args ...any) {
+	logger.Log(clibs.Event{
+		Time:  time.Now(),
+		Level: level,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+// fatalf 输出错误并退出
+func fatalf(logger clibs.Logger, format string, args ...any) {
+	logf(logger, clibs.LevelError, format, args...)
+	os.Exit(1)
+}
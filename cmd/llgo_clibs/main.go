@@ -1,32 +1,122 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cpunion/clibs"
 )
 
 func main() {
+	// Ctrl-C 或 SIGTERM 时取消所有子进程
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// 定义子命令
 	buildCmd := flag.NewFlagSet("build", flag.ExitOnError)
 	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
 	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+	infoCmd := flag.NewFlagSet("info", flag.ExitOnError)
+	cleanCmd := flag.NewFlagSet("clean", flag.ExitOnError)
+	packageCmd := flag.NewFlagSet("package", flag.ExitOnError)
+	publishCmd := flag.NewFlagSet("publish", flag.ExitOnError)
+	keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	compdbCmd := flag.NewFlagSet("compdb", flag.ExitOnError)
+	flagsCmd := flag.NewFlagSet("flags", flag.ExitOnError)
 
 	// build 命令的标志
-	buildForce := buildCmd.Bool("force", false, "Force rebuild even if already built")
-	buildPrebuilt := buildCmd.Bool("prebuilt", false, "Build to prebuilt directory")
-	buildTags := buildCmd.String("tags", "", "A comma-separated list of build tags")
+	var buildOpts buildOptions
+	buildCmd.BoolVar(&buildOpts.force, "force", false, "Force rebuild even if already built")
+	buildCmd.BoolVar(&buildOpts.prebuilt, "prebuilt", false, "Build to prebuilt directory")
+	buildCmd.StringVar(&buildOpts.tags, "tags", "", "A comma-separated list of build tags")
+	buildCmd.StringVar(&buildOpts.profile, "profile", "release", "Build profile: release, debug, asan or ubsan")
+	buildCmd.DurationVar(&buildOpts.timeout, "timeout", 0, "Timeout for each fetch and build step, 0 means no timeout")
+	buildCmd.StringVar(&buildOpts.targets, "targets", "", "A comma-separated list of GOOS/GOARCH targets, default $GOOS/$GOARCH")
+	buildCmd.BoolVar(&buildOpts.dryRun, "n", false, "Print what would be done and why, without building")
+	buildCmd.StringVar(&buildOpts.policy, "prebuilt-policy", "prefer", "Use prebuilt libs: never, prefer or require")
+	buildCmd.BoolVar(&buildOpts.compdb, "compile-commands", false, "Record "+clibs.CompileCommandsFile+" in the build dirs")
+	buildCmd.BoolVar(&buildOpts.requireSig, "require-signature", false, "Refuse prebuilt archives not signed by a trusted key")
+	buildCmd.BoolVar(&buildOpts.requireSum, "require-checksum", false, "Refuse prebuilt archives whose sha256 is not published")
+	buildCmd.StringVar(&buildOpts.format, "format", "text", "Output format of the -n plan: text or json")
+	buildLog := addLogFlags(buildCmd)
 
 	// export 命令的标志
-	exportPrebuilt := exportCmd.Bool("prebuilt", false, "Export from prebuilt directory")
-	exportTags := exportCmd.String("tags", "", "A comma-separated list of build tags")
+	var exportOpts exportOptions
+	exportCmd.BoolVar(&exportOpts.prebuilt, "prebuilt", false, "Export from prebuilt directory")
+	exportCmd.StringVar(&exportOpts.tags, "tags", "", "A comma-separated list of build tags")
+	exportCmd.StringVar(&exportOpts.profile, "profile", "release", "Build profile: release, debug, asan or ubsan")
+	exportCmd.BoolVar(&exportOpts.build, "build", false, "Build libs that are not built for the target yet")
+	exportCmd.StringVar(&exportOpts.cmakePrefix, "cmake", "", "Write CMake package configs of the libs into this prefix and print CMAKE_PREFIX_PATH")
+	exportCmd.BoolVar(&exportOpts.cgo, "cgo", false, "Print CGO_CFLAGS, CGO_LDFLAGS and CC for the standard Go toolchain")
+	exportCmd.StringVar(&exportOpts.cgoFile, "cgo-file", "", "Write #cgo directives to this file, e.g. "+clibs.CgoFileName+" from go generate")
+	exportCmd.StringVar(&exportOpts.format, "format", "raw", "Output format: raw, json, shell, dotenv or github-env")
+	exportCmd.DurationVar(&exportOpts.timeout, "timeout", 0, "Timeout for each export step, 0 means no timeout")
+	exportLog := addLogFlags(exportCmd)
 
 	// list 命令的标志
 	listTags := listCmd.String("tags", "", "A comma-separated list of build tags")
+	listLog := addLogFlags(listCmd)
+
+	// verify 命令的标志
+	verifyTags := verifyCmd.String("tags", "", "A comma-separated list of build tags")
+	verifyLog := addLogFlags(verifyCmd)
+
+	// status 命令的标志
+	statusTags := statusCmd.String("tags", "", "A comma-separated list of build tags")
+	statusProfile := statusCmd.String("profile", "release", "Build profile of the current target")
+	statusLog := addLogFlags(statusCmd)
+
+	// info 命令的标志
+	infoTags := infoCmd.String("tags", "", "A comma-separated list of build tags")
+	infoProfile := infoCmd.String("profile", "release", "Build profile: release, debug, asan or ubsan")
+	infoLog := addLogFlags(infoCmd)
+
+	// clean 命令的标志
+	cleanTags := cleanCmd.String("tags", "", "A comma-separated list of build tags")
+	cleanTarget := cleanCmd.String("target", "", "Only clean this GOOS/GOARCH target, default all targets")
+	cleanLog := addLogFlags(cleanCmd)
+
+	// package 命令的标志
+	var packageOpts packageOptions
+	packageCmd.BoolVar(&packageOpts.force, "force", false, "Force rebuild even if already built")
+	packageCmd.StringVar(&packageOpts.tags, "tags", "", "A comma-separated list of build tags")
+	packageCmd.StringVar(&packageOpts.targets, "targets", "", "A comma-separated list of GOOS/GOARCH targets, default the current target")
+	packageCmd.StringVar(&packageOpts.outDir, "o", "dist", "Output directory of the archives and "+clibs.SumsFile)
+	packageCmd.DurationVar(&packageOpts.timeout, "timeout", 0, "Timeout for each fetch and build step, 0 means no timeout")
+	packageCmd.StringVar(&packageOpts.signKey, "sign", "", "Sign the archives with this ed25519 private key (PEM)")
+	packageLog := addLogFlags(packageCmd)
+
+	// publish 命令的标志
+	publishTags := publishCmd.String("tags", "", "A comma-separated list of build tags")
+	publishDir := publishCmd.String("dir", "dist", "Directory of the archives written by package")
+	publishTo := publishCmd.String("to", "", "Artifact store URL (http, https or file) or path, default $"+clibs.EnvPrebuiltURL)
+	publishLog := addLogFlags(publishCmd)
+
+	// keygen 命令的标志
+	keygenLog := addLogFlags(keygenCmd)
+
+	// compdb 命令的标志
+	compdbTags := compdbCmd.String("tags", "", "A comma-separated list of build tags")
+	compdbProfile := compdbCmd.String("profile", "release", "Build profile: release, debug, asan or ubsan")
+	compdbOut := compdbCmd.String("o", clibs.CompileCommandsFile, "Output file of the merged compilation database")
+	compdbLog := addLogFlags(compdbCmd)
+
+	// flags 命令的标志
+	flagsTags := flagsCmd.String("tags", "", "A comma-separated list of build tags")
+	flagsProfile := flagsCmd.String("profile", "release", "Build profile: release, debug, asan or ubsan")
+	flagsFormat := flagsCmd.String("format", "text", "Output format: text or json")
+	flagsTimeout := flagsCmd.Duration("timeout", 0, "Timeout for each go list and $(command) step, 0 means no timeout")
+	flagsLog := addLogFlags(flagsCmd)
 
 	// 检查是否提供了子命令
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'build', 'export' or 'list' subcommands")
+		fmt.Println("Expected 'build', 'export', 'list', 'verify', 'status', 'info', 'clean', 'cache', 'package', 'publish', 'keygen', 'compdb' or 'flags' subcommands")
 		os.Exit(1)
 	}
 
@@ -34,16 +124,45 @@ func main() {
 	switch os.Args[1] {
 	case "build":
 		buildCmd.Parse(os.Args[2:])
-		runBuild(*buildForce, *buildPrebuilt, *buildTags, buildCmd.Args())
+		runBuild(ctx, buildLog.logger(), buildOpts, buildCmd.Args())
 	case "export":
 		exportCmd.Parse(os.Args[2:])
-		runExport(*exportPrebuilt, *exportTags, exportCmd.Args())
+		runExport(ctx, exportLog.logger(), exportOpts, exportCmd.Args())
 	case "list":
 		listCmd.Parse(os.Args[2:])
-		runList(*listTags, listCmd.Args())
+		runList(ctx, listLog.logger(), *listTags, listCmd.Args())
+	case "verify":
+		verifyCmd.Parse(os.Args[2:])
+		runVerify(ctx, verifyLog.logger(), *verifyTags, verifyCmd.Args())
+	case "status":
+		statusCmd.Parse(os.Args[2:])
+		runStatus(ctx, statusLog.logger(), *statusTags, *statusProfile, statusCmd.Args())
+	case "info":
+		infoCmd.Parse(os.Args[2:])
+		runInfo(ctx, infoLog.logger(), *infoTags, *infoProfile, infoCmd.Args())
+	case "clean":
+		cleanCmd.Parse(os.Args[2:])
+		runClean(ctx, cleanLog.logger(), *cleanTags, *cleanTarget, cleanCmd.Args())
+	case "cache":
+		runCache(ctx, os.Args[2:])
+	case "package":
+		packageCmd.Parse(os.Args[2:])
+		runPackage(ctx, packageLog.logger(), packageOpts, packageCmd.Args())
+	case "publish":
+		publishCmd.Parse(os.Args[2:])
+		runPublish(ctx, publishLog.logger(), *publishTags, *publishDir, *publishTo, publishCmd.Args())
+	case "keygen":
+		keygenCmd.Parse(os.Args[2:])
+		runKeygen(keygenLog.logger(), keygenCmd.Args())
+	case "compdb":
+		compdbCmd.Parse(os.Args[2:])
+		runCompdb(ctx, compdbLog.logger(), *compdbTags, *compdbProfile, *compdbOut, compdbCmd.Args())
+	case "flags":
+		flagsCmd.Parse(os.Args[2:])
+		runFlags(ctx, flagsLog.logger(), *flagsFormat, *flagsTags, *flagsProfile, *flagsTimeout, flagsCmd.Args())
 	default:
 		fmt.Printf("%s is not a valid command.\n", os.Args[1])
-		fmt.Println("Expected 'build', 'export' or 'list' subcommands")
+		fmt.Println("Expected 'build', 'export', 'list', 'verify', 'status', 'info', 'clean', 'cache', 'package', 'publish', 'keygen', 'compdb' or 'flags' subcommands")
 		os.Exit(1)
 	}
 }
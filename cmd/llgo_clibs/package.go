@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cpunion/clibs"
+)
+
+// packageOptions 是 package 命令的标志
+type packageOptions struct {
+	force   bool
+	tags    string
+	targets string
+	outDir  string
+	signKey string
+	timeout time.Duration
+}
+
+// runPackage 执行 package 命令
+func runPackage(ctx context.Context, logger clibs.Logger, opts packageOptions, args []string) {
+	config := clibs.Config{
+		Force:       opts.force,
+		Tags:        tagArgs(opts.tags),
+		StepTimeout: opts.timeout,
+		Logger:      logger,
+	}
+
+	if opts.signKey != "" {
+		key, err := clibs.LoadSigningKey(opts.signKey)
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+		config.SigningKey = key
+	}
+
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+	if len(libs) == 0 {
+		fmt.Println("No C libraries found.")
+		return
+	}
+
+	if opts.targets == "" {
+		goos, goarch := envTarget()
+		opts.targets = goos + "/" + goarch
+	}
+	parsed, err := clibs.ParseTargets(opts.targets)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	for _, target := range parsed {
+		config.Goos, config.Goarch = target.Goos, target.Goarch
+		results, err := clibs.Package(ctx, config, libs, opts.outDir)
+		for _, result := range results {
+			fmt.Printf("%s  %s\n", result.Sha256, result.Archive)
+		}
+		if err != nil {
+			fatalf(logger, "%v", err)
+		}
+	}
+}
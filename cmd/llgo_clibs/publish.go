@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cpunion/clibs"
+)
+
+// runPublish 执行 publish 命令
+func runPublish(ctx context.Context, logger clibs.Logger, tags, dir, dest string, args []string) {
+	if dest == "" {
+		dest = envOr(clibs.EnvPrebuiltURL, "")
+	}
+	if dest == "" {
+		fatalf(logger, "publish needs -to or $%s", clibs.EnvPrebuiltURL)
+	}
+
+	config := clibs.Config{Tags: tagArgs(tags), Logger: logger}
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	published, err := clibs.Publish(ctx, config, libs, dir, dest)
+	for _, url := range published {
+		fmt.Println(url)
+	}
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	if len(published) == 0 {
+		fmt.Println("No prebuilt archives published.")
+	}
+}
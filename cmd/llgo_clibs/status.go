@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cpunion/clibs"
+)
+
+// runStatus 执行 status 命令
+func runStatus(ctx context.Context, logger clibs.Logger, tags, profile string, args []string) {
+	buildProfile, err := clibs.ParseProfile(profile)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+
+	goos, goarch := envTarget()
+	config := clibs.Config{
+		Goos:    goos,
+		Goarch:  goarch,
+		Profile: buildProfile,
+		Tags:    tagArgs(tags),
+		Logger:  logger,
+	}
+
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	statuses, err := clibs.Status(config, libs)
+	if err != nil {
+		fatalf(logger, "%v", err)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No C libraries found.")
+		return
+	}
+
+	for _, status := range statuses {
+		fmt.Printf("%s\n", status.Lib.ModName)
+		fmt.Printf("  Base: %s\n", status.BaseDir)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, dir := range status.Dirs {
+			name := dir.Kind
+			if dir.Target != "" {
+				name += "/" + dir.Target
+			}
+			modTime := ""
+			if !dir.ModTime.IsZero() {
+				modTime = dir.ModTime.Local().Format("2006-01-02 15:04:05")
+			}
+			size := ""
+			if dir.State != clibs.DirMissing {
+				size = formatSize(dir.Size)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", name, dir.State, size, modTime, dir.Reason)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+}
+
+// formatSize 以易读的单位格式化字节数
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
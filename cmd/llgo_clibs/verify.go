@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cpunion/clibs"
+)
+
+// runVerify 执行 verify 命令
+func runVerify(ctx context.Context, logger clibs.Logger, tags string, args []string) {
+	config := clibs.Config{Tags: tagArgs(tags), Logger: logger}
+	libs, err := clibs.ListLibsContext(ctx, config, args...)
+	if err != nil {
+		fatalf(logger, "Error getting C library libs: %v", err)
+	}
+
+	results := clibs.Verify(config, libs)
+	if len(results) == 0 {
+		fmt.Println("No built libraries found.")
+		return
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", result.Lib.ModName, result.Err)
+			continue
+		}
+		fmt.Printf("ok   %s: %s\n", result.Lib.ModName, result.Dir)
+	}
+
+	if failed > 0 {
+		fatalf(logger, "%d of %d directories failed verification", failed, len(results))
+	}
+}
@@ -0,0 +1,213 @@
+package clibs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompileCommandsFile is the compilation database written into build dirs
+const CompileCommandsFile = "compile_commands.json"
+
+// CompileCommand is an entry of a compilation database
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// compileRecorder wraps CC and CXX with scripts logging every invocation
+type compileRecorder struct {
+	dir string
+}
+
+// newCompileRecorder writes the wrappers into a temporary dir
+func newCompileRecorder() (*compileRecorder, error) {
+	dir, err := os.MkdirTemp("", "clibs-cc-")
+	if err != nil {
+		return nil, err
+	}
+	r := &compileRecorder{dir: dir}
+	for _, c := range []struct{ name, env, def string }{{"cc", "CC", "cc"}, {"c++", "CXX", "c++"}} {
+		real := os.Getenv(c.env)
+		if real == "" {
+			real = c.def
+		}
+		var quoted []string
+		for _, word := range strings.Fields(real) {
+			quoted = append(quoted, shellQuote(word))
+		}
+		// Each record is the arg count, the dir, the compiler words and
+		// the args, NUL separated
+		script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\0' \"$#\" \"$PWD\" %d %s \"$@\" >> %s/log.$$\nexec %s \"$@\"\n",
+			len(quoted), strings.Join(quoted, " "), shellQuote(dir), strings.Join(quoted, " "))
+		if err := os.WriteFile(filepath.Join(dir, c.name), []byte(script), 0755); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// env returns CC and CXX pointing at the wrappers
+func (r *compileRecorder) env() []string {
+	return []string{
+		"CC=" + filepath.Join(r.dir, "cc"),
+		"CXX=" + filepath.Join(r.dir, "c++"),
+	}
+}
+
+func (r *compileRecorder) Close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// commands parses the logged invocations into compile commands, one per
+// source file compiled with -c. Files gone after the build, such as the
+// conftest.c of configure checks, are dropped.
+func (r *compileRecorder) commands() ([]CompileCommand, error) {
+	logs, err := filepath.Glob(filepath.Join(r.dir, "log.*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(logs)
+	var commands []CompileCommand
+	for _, log := range logs {
+		content, err := os.ReadFile(log)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Split(strings.TrimSuffix(string(content), "\x00"), "\x00")
+		for len(fields) >= 3 {
+			nargs, err1 := strconv.Atoi(fields[0])
+			ncc, err2 := strconv.Atoi(fields[2])
+			if err1 != nil || err2 != nil || len(fields) < 3+ncc+nargs {
+				return nil, fmt.Errorf("corrupted compiler log %s", log)
+			}
+			dir := fields[1]
+			args := append(fields[3:3+ncc:3+ncc], fields[3+ncc:3+ncc+nargs]...)
+			for _, command := range compileCommands(dir, args) {
+				if _, err := os.Stat(command.File); err == nil {
+					commands = append(commands, command)
+				}
+			}
+			fields = fields[3+ncc+nargs:]
+		}
+	}
+	return commands, nil
+}
+
+// sourceExts are the extensions of files compiled by C compilers
+var sourceExts = map[string]bool{
+	".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".c++": true,
+	".C": true, ".m": true, ".mm": true, ".S": true, ".s": true,
+}
+
+// compileCommands returns an entry for every source file of a compiler
+// invocation with -c
+func compileCommands(dir string, args []string) []CompileCommand {
+	compile := false
+	output := ""
+	var sources []string
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-c":
+			compile = true
+		case arg == "-o" && i+1 < len(args):
+			i++
+			output = args[i]
+		case strings.HasPrefix(arg, "-"):
+		case sourceExts[filepath.Ext(arg)]:
+			sources = append(sources, arg)
+		}
+	}
+	if !compile {
+		return nil
+	}
+	var commands []CompileCommand
+	for _, source := range sources {
+		file := source
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		commands = append(commands, CompileCommand{
+			Directory: dir,
+			File:      file,
+			Arguments: args,
+			Output:    output,
+		})
+	}
+	return commands
+}
+
+// writeCompileCommands writes commands as a compilation database
+func writeCompileCommands(path string, commands []CompileCommand) error {
+	if commands == nil {
+		commands = []CompileCommand{}
+	}
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// hasCompileCommands reports whether dir satisfies config.CompileCommands
+func (c Config) hasCompileCommands(dir string) bool {
+	if !c.CompileCommands {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dir, CompileCommandsFile))
+	return err == nil
+}
+
+// MergeCompileCommands merges the compilation databases of libs, built
+// for the target of config with CompileCommands set, into one database at
+// path. It also writes a .clangd file into the download dir of each lib,
+// so clangd finds the database of fetched sources. Libs without a
+// database are skipped with a warning.
+func MergeCompileCommands(config Config, libs []*Lib, path string) ([]CompileCommand, error) {
+	config = config.buildDefaults()
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	var merged []CompileCommand
+	for _, lib := range libs {
+		log := config.libLogger(lib)
+		if err := lib.resolveEnv(config); err != nil {
+			return nil, newError(lib, targetTriple, PhaseExport, err)
+		}
+		dir := envValue(lib.Env, EnvBuildDir)
+		data, err := os.ReadFile(filepath.Join(dir, CompileCommandsFile))
+		if os.IsNotExist(err) {
+			log.warnf("no %s in %s, rebuild with -compile-commands", CompileCommandsFile, dir)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var commands []CompileCommand
+		if err := json.Unmarshal(data, &commands); err != nil {
+			return nil, newError(lib, targetTriple, PhaseExport, fmt.Errorf("%s: %v", CompileCommandsFile, err))
+		}
+		merged = append(merged, commands...)
+
+		downloadDir, err := getDownloadDir(config, lib)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(downloadDir); err == nil {
+			clangd := fmt.Sprintf("CompileFlags:\n  CompilationDatabase: %s\n", strconv.Quote(dir))
+			if err := os.WriteFile(filepath.Join(downloadDir, ".clangd"), []byte(clangd), 0644); err != nil {
+				log.warnf("Failed to write .clangd: %v", err)
+			}
+		}
+	}
+	if path != "" {
+		if err := writeCompileCommands(path, merged); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,83 @@
+package clibs
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileCommands(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc not found")
+	}
+	config := Config{Goos: "linux", Goarch: "amd64", Logger: Discard}
+	lib := &Lib{
+		ModName: "example.com/compdb",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name: "compdb",
+			Build: &BuildSpec{Command: `
+mkdir -p src
+echo 'int a(void) { return 1; }' > src/a.c
+echo 'int b(void) { return 2; }' > "b file.c"
+${CC:-cc} -DA -c src/a.c -o a.o
+${CC:-cc} -c "b file.c" -o b.o
+${CC:-cc} -r a.o b.o -o "$CLIBS_BUILD_DIR/compdb.o"
+echo 'int main(void) { return 0; }' > conftest.c
+${CC:-cc} -c conftest.c -o conftest.o
+rm -f conftest.c conftest.o`},
+		},
+	}
+	if err := Build(config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+	buildDir := filepath.Join(lib.Path, BuildDirName, "x86_64-unknown-linux")
+	if _, err := os.Stat(filepath.Join(buildDir, CompileCommandsFile)); err == nil {
+		t.Fatalf("%s recorded without CompileCommands", CompileCommandsFile)
+	}
+
+	// Recording rebuilds the otherwise up to date lib
+	config.CompileCommands = true
+	if err := Build(config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), CompileCommandsFile)
+	if _, err := MergeCompileCommands(config, []*Lib{lib}, out); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []CompileCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("got %d commands, want 2: %s", len(commands), data)
+	}
+	downloadDir := filepath.Join(lib.Path, DownloadDirName)
+	wantFiles := []string{filepath.Join(downloadDir, "src", "a.c"), filepath.Join(downloadDir, "b file.c")}
+	for i, command := range commands {
+		if command.File != wantFiles[i] || command.Directory != downloadDir {
+			t.Errorf("command %d: %+v", i, command)
+		}
+		if strings.Contains(command.Arguments[0], "clibs-cc-") {
+			t.Errorf("wrapper recorded instead of the compiler: %v", command.Arguments)
+		}
+	}
+	if !reflect.DeepEqual(commands[0].Arguments[1:], []string{"-DA", "-c", "src/a.c", "-o", "a.o"}) {
+		t.Errorf("unexpected arguments %q", commands[0].Arguments)
+	}
+	clangd, err := os.ReadFile(filepath.Join(downloadDir, ".clangd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(clangd), buildDir) {
+		t.Errorf("unexpected .clangd: %s", clangd)
+	}
+}
@@ -0,0 +1,69 @@
+package clibs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Phase identifies the step of the pipeline that failed
+type Phase string
+
+const (
+	PhaseList     Phase = "list"
+	PhaseFetch    Phase = "fetch"
+	PhasePrebuilt Phase = "prebuilt"
+	PhaseBuild    Phase = "build"
+	PhaseExport   Phase = "export"
+	PhasePackage  Phase = "package"
+	PhasePublish  Phase = "publish"
+)
+
+// Error is returned by the library API and carries the lib, target and
+// phase that failed. Use errors.Is(err, context.Canceled) or
+// context.DeadlineExceeded to detect cancellation and timeouts.
+type Error struct {
+	Lib    string
+	Target string
+	Phase  Phase
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := string(e.Phase)
+	if e.Target != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Target)
+	}
+	if e.Lib != "" {
+		msg = e.Lib + ": " + msg
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError wraps err with lib, target and phase unless it already is an *Error
+func newError(lib *Lib, target string, phase Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	name := ""
+	if lib != nil {
+		name = lib.ModName
+	}
+	return &Error{Lib: name, Target: target, Phase: phase, Err: err}
+}
+
+// stepContext limits a single step to config.StepTimeout
+func (c Config) stepContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.StepTimeout > 0 {
+		return context.WithTimeout(ctx, c.StepTimeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -2,38 +2,89 @@ package clibs
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"slices"
 	"strings"
 )
 
+// ErrNotBuilt is returned when exporting a lib that has not been built for
+// the target
+var ErrNotBuilt = errors.New("not built")
+
+// Export runs the export script of every lib
 func Export(config Config, libs []*Lib) (exports []string, err error) {
+	return ExportContext(context.Background(), config, libs)
+}
+
+// ExportContext is like Export, killing export scripts when ctx is done.
+// The pkg-config dirs of all libs follow as one PKG_CONFIG_PATH line.
+func ExportContext(ctx context.Context, config Config, libs []*Lib) (exports []string, err error) {
 	for _, lib := range libs {
-		libExports, err := lib.Export(config)
+		libExports, err := lib.ExportContext(ctx, config)
 		if err != nil {
 			return nil, err
 		}
 		exports = append(exports, libExports...)
 	}
+	pcPath, err := pkgConfigPathVar(config, libs)
+	if err != nil {
+		return nil, err
+	}
+	if pcPath.Value != "" {
+		exports = append(exports, pcPath.Key+"="+pcPath.Value)
+	}
 	return
 }
 
+// Export evaluates the exports and runs the export script of the lib
 func (p *Lib) Export(config Config) (exports []string, err error) {
-	if p.Config.Export == "" {
+	return p.ExportContext(context.Background(), config)
+}
+
+// ExportContext is like Export, killing the export script when ctx is done.
+// The declarative Exports of the lib come first. Unless lib.Env is the env
+// of a build for the target of config, the prebuilt or build dir left by a
+// previous build is used, failing with ErrNotBuilt if there is none. Libs
+// exporting nothing need no build.
+func (p *Lib) ExportContext(ctx context.Context, config Config) (exports []string, err error) {
+	if !p.Config.hasExports() {
 		return nil, nil
 	}
+	config = config.buildDefaults()
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	if err := p.resolveEnv(config); err != nil {
+		return nil, newError(p, targetTriple, PhaseExport, err)
+	}
+	if len(p.Config.Exports) > 0 {
+		if exports, err = p.Config.expandExports(p.Env); err != nil {
+			return nil, newError(p, targetTriple, PhaseExport, err)
+		}
+	}
+	if p.Config.Export == "" {
+		return exports, nil
+	}
+
 	// Execute the export command using bash
-	cmd := exec.Command("bash", "-e", "-c", p.Config.Export)
+	ctx, cancel := config.stepContext(ctx)
+	defer cancel()
+	cmd := commandContext(ctx, "bash", "-e", "-c", p.Config.Export)
 	cmd.Dir = p.Path
-	cmd.Env = p.Env
+	cmd.Env = append(os.Environ(), p.Env...)
+
+	stderr := config.libLogger(p).output()
+	cmd.Stderr = stderr
 
 	output, err := cmd.Output()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error executing export command: %v\n", err)
-		fmt.Fprintf(os.Stderr, "command: %s\n", p.Config.Export)
-		fmt.Printf("  Command output:\n%s\n", output)
-		return nil, fmt.Errorf("export command failed: %v", err)
+		log := config.libLogger(p)
+		log.debugf("Export command:\n%s", p.Config.Export)
+		log.debugf("Command output:\n%s", output)
+		return nil, newError(p, targetTriple, PhaseExport, fmt.Errorf("export command failed: %w\n%s", runError(ctx, err), stderr.Tail()))
 	}
 
 	// Parse the output for key=value pairs
@@ -47,8 +98,243 @@ func (p *Lib) Export(config Config) (exports []string, err error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return exports, fmt.Errorf("error scanning output: %v", err)
+		return exports, newError(p, targetTriple, PhaseExport, fmt.Errorf("error scanning output: %v", err))
 	}
 
 	return exports, nil
 }
+
+// hasExports reports whether the spec exports anything: an export script,
+// declarative Exports or a pkg-config file
+func (c *LibSpec) hasExports() bool {
+	return c.Export != "" || len(c.Exports) > 0 || c.PkgConfig != nil
+}
+
+// resolveEnv sets lib.Env to the env of the prebuilt or build dir left by
+// a previous build for the target of config, unless it is already set
+func (p *Lib) resolveEnv(config Config) error {
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	if envValue(p.Env, EnvBuildTarget) == targetTriple && envValue(p.Env, EnvBuildProfile) == string(config.Profile) {
+		return nil
+	}
+	dir, built, err := p.resolveDir(config)
+	if err != nil {
+		return err
+	}
+	if !built {
+		return fmt.Errorf("%w in %s, run `llgo_clibs build` first", ErrNotBuilt, dir)
+	}
+	env, err := getBuildEnv(config, p, dir)
+	if err != nil {
+		return err
+	}
+	p.Env = env
+	return nil
+}
+
+// ExportVar is a variable exported by one or more libs
+type ExportVar struct {
+	Key   string   `json:"key"`
+	Value string   `json:"value"`
+	Libs  []string `json:"libs"`
+}
+
+// ExportVars runs the export scripts of libs and collects their KEY=VALUE
+// lines in order of first appearance. Values of list-like keys, *FLAGS and
+// *PATH, exported by several libs are merged. Other duplicate keys are
+// reported as warnings and the later lib wins. The pkg-config dirs of all
+// libs are merged into PKG_CONFIG_PATH last.
+func ExportVars(ctx context.Context, config Config, libs []*Lib) ([]ExportVar, error) {
+	var vars []ExportVar
+	index := make(map[string]int)
+	for _, lib := range libs {
+		log := config.libLogger(lib)
+		lines, err := lib.ExportContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			key, value, ok := parseExportLine(line)
+			if !ok {
+				log.warnf("ignoring export line not of the form KEY=VALUE: %s", line)
+				continue
+			}
+			i, seen := index[key]
+			if !seen {
+				index[key] = len(vars)
+				vars = append(vars, ExportVar{Key: key, Value: value, Libs: []string{lib.ModName}})
+				continue
+			}
+			v := &vars[i]
+			if sep, ok := listSeparator(key); ok {
+				v.Value = mergeList(v.Value, value, sep)
+			} else if v.Value != value {
+				log.warnf("%s exported by %s is overridden: %q replaces %q", key, strings.Join(v.Libs, ", "), value, v.Value)
+				v.Value = value
+			}
+			if v.Libs[len(v.Libs)-1] != lib.ModName {
+				v.Libs = append(v.Libs, lib.ModName)
+			}
+		}
+	}
+
+	pcPath, err := pkgConfigPathVar(config, libs)
+	if err != nil {
+		return nil, err
+	}
+	if pcPath.Value == "" {
+		return vars, nil
+	}
+	i, seen := index[pcPath.Key]
+	if !seen {
+		return append(vars, pcPath), nil
+	}
+	v := &vars[i]
+	v.Value = mergeList(v.Value, pcPath.Value, string(os.PathListSeparator))
+	for _, name := range pcPath.Libs {
+		if !slices.Contains(v.Libs, name) {
+			v.Libs = append(v.Libs, name)
+		}
+	}
+	return vars, nil
+}
+
+// parseExportLine splits a KEY=VALUE line, accepting a leading "export"
+func parseExportLine(line string) (key, value string, ok bool) {
+	line = strings.TrimPrefix(line, "export ")
+	key, value, ok = strings.Cut(line, "=")
+	if !ok || !isEnvKey(key) {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+func isEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// listSeparator returns the separator of list-like variables
+func listSeparator(key string) (string, bool) {
+	switch {
+	case strings.HasSuffix(key, "FLAGS"):
+		return " ", true
+	case strings.HasSuffix(key, "PATH"):
+		return string(os.PathListSeparator), true
+	}
+	return "", false
+}
+
+// mergeList appends the elements of value missing from list
+func mergeList(list, value, sep string) string {
+	if list == "" {
+		return value
+	}
+	if sep == " " {
+		// Flags are kept as is, "-framework X" would not survive dedup
+		if value == "" || value == list {
+			return list
+		}
+		return list + sep + value
+	}
+	seen := make(map[string]bool)
+	elems := strings.Split(list, sep)
+	for _, elem := range elems {
+		seen[elem] = true
+	}
+	for _, elem := range strings.Split(value, sep) {
+		if elem != "" && !seen[elem] {
+			seen[elem] = true
+			elems = append(elems, elem)
+		}
+	}
+	return strings.Join(elems, sep)
+}
+
+// ExportFormat selects how WriteExports prints variables
+type ExportFormat string
+
+const (
+	// FormatJSON prints a JSON array of ExportVar
+	FormatJSON ExportFormat = "json"
+	// FormatShell prints export statements for eval in sh
+	FormatShell ExportFormat = "shell"
+	// FormatDotenv prints KEY="VALUE" lines for .env files
+	FormatDotenv ExportFormat = "dotenv"
+	// FormatGitHubEnv prints the $GITHUB_ENV file syntax of GitHub Actions
+	FormatGitHubEnv ExportFormat = "github-env"
+)
+
+// ParseExportFormat parses a format name
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch f := ExportFormat(strings.ToLower(name)); f {
+	case FormatJSON, FormatShell, FormatDotenv, FormatGitHubEnv:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format %q (expected json, shell, dotenv or github-env)", name)
+}
+
+// WriteExports prints vars in format to w
+func WriteExports(w io.Writer, format ExportFormat, vars []ExportVar) error {
+	if format == FormatJSON {
+		if vars == nil {
+			vars = []ExportVar{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(vars)
+	}
+	bw := bufio.NewWriter(w)
+	for _, v := range vars {
+		switch format {
+		case FormatShell:
+			fmt.Fprintf(bw, "export %s=%s\n", v.Key, shellQuote(v.Value))
+		case FormatDotenv:
+			fmt.Fprintf(bw, "%s=%s\n", v.Key, dotenvQuote(v.Value))
+		case FormatGitHubEnv:
+			if !strings.ContainsAny(v.Value, "\r\n") {
+				fmt.Fprintf(bw, "%s=%s\n", v.Key, v.Value)
+				continue
+			}
+			delim := "CLIBS_EOF"
+			for strings.Contains(v.Value, delim) {
+				delim += "_"
+			}
+			fmt.Fprintf(bw, "%s<<%s\n%s\n%s\n", v.Key, delim, v.Value, delim)
+		default:
+			return fmt.Errorf("unknown export format %q", format)
+		}
+	}
+	return bw.Flush()
+}
+
+// shellQuote quotes s for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// dotenvQuote double-quotes s, escaping what dotenv parsers expand
+func dotenvQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "$", `\$`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// envValue returns the value of key in env, a list of KEY=VALUE
+func envValue(env []string, key string) string {
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
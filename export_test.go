@@ -0,0 +1,153 @@
+package clibs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportVars(t *testing.T) {
+	var logs bytes.Buffer
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: NewTextLogger(&logs, LevelWarn)}
+	libs := []*Lib{
+		{ModName: "example.com/a", Path: t.TempDir(), Config: LibSpec{Name: "a", Export: `
+echo CFLAGS=-I/a/include
+echo PKG_CONFIG_PATH=/a/lib/pkgconfig
+echo A_ROOT=/a
+echo not an export`}},
+		{ModName: "example.com/b", Path: t.TempDir(), Config: LibSpec{Name: "b", Export: `
+echo CFLAGS=-I/b/include
+echo PKG_CONFIG_PATH=/a/lib/pkgconfig:/b/lib/pkgconfig
+echo export A_ROOT=/b`}},
+	}
+	if err := BuildContext(context.Background(), config, libs); err != nil {
+		t.Fatal(err)
+	}
+	vars, err := ExportVars(context.Background(), config, libs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sep := string(os.PathListSeparator)
+	want := []ExportVar{
+		{Key: "CFLAGS", Value: "-I/a/include -I/b/include", Libs: []string{"example.com/a", "example.com/b"}},
+		{Key: "PKG_CONFIG_PATH", Value: "/a/lib/pkgconfig" + sep + "/b/lib/pkgconfig", Libs: []string{"example.com/a", "example.com/b"}},
+		{Key: "A_ROOT", Value: "/b", Libs: []string{"example.com/a", "example.com/b"}},
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Fatalf("got %+v\nwant %+v", vars, want)
+	}
+	for _, msg := range []string{"not an export", "A_ROOT exported by example.com/a is overridden"} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("no warning about %q in:\n%s", msg, logs.String())
+		}
+	}
+}
+
+func TestWriteExports(t *testing.T) {
+	vars := []ExportVar{
+		{Key: "CFLAGS", Value: `-DNAME="it's $HOME"`, Libs: []string{"example.com/a"}},
+		{Key: "NOTES", Value: "line 1\nline 2", Libs: []string{"example.com/a"}},
+	}
+	tests := []struct {
+		format ExportFormat
+		want   string
+	}{
+		{FormatShell, `export CFLAGS='-DNAME="it'\''s $HOME"'` + "\n" + "export NOTES='line 1\nline 2'\n"},
+		{FormatDotenv, `CFLAGS="-DNAME=\"it's \$HOME\""` + "\n" + `NOTES="line 1\nline 2"` + "\n"},
+		{FormatGitHubEnv, `CFLAGS=-DNAME="it's $HOME"` + "\n" + "NOTES<<CLIBS_EOF\nline 1\nline 2\nCLIBS_EOF\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteExports(&buf, tt.format, vars); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, buf.String(), tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteExports(&buf, FormatJSON, vars); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []ExportVar
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, vars) {
+		t.Fatalf("json round trip: got %+v", decoded)
+	}
+}
+
+func TestDeclarativeExports(t *testing.T) {
+	lib := &Lib{
+		ModName: "example.com/decl",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name: "decl",
+			Exports: map[string]string{
+				"DECL_INCLUDE": "${CLIBS_BUILD_DIR}/include",
+				"DECL_PRICE":   "$$5 for ${CLIBS_BUILD_TARGET}",
+			},
+			Export: `echo DECL_SCRIPT=$(basename "$CLIBS_BUILD_DIR")`,
+		},
+	}
+	config := Config{Goos: "linux", Goarch: "amd64", Logger: Discard}
+	if _, err := lib.Export(config); !errors.Is(err, ErrNotBuilt) {
+		t.Fatalf("exported unbuilt lib: %v", err)
+	}
+	// Nothing to export, nothing to build
+	bare := &Lib{ModName: "example.com/bare", Path: t.TempDir(), Config: LibSpec{Name: "bare"}}
+	if exports, err := bare.Export(config); err != nil || exports != nil {
+		t.Fatalf("unbuilt lib without exports: got %q, %v", exports, err)
+	}
+	if err := Build(config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh lib resolves the build dir left by the build
+	lib = &Lib{ModName: lib.ModName, Path: lib.Path, Config: lib.Config}
+	exports, err := lib.Export(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildDir := filepath.Join(lib.Path, BuildDirName, "x86_64-unknown-linux")
+	want := []string{
+		"DECL_INCLUDE=" + buildDir + "/include",
+		"DECL_PRICE=$5 for x86_64-unknown-linux",
+		"DECL_SCRIPT=x86_64-unknown-linux",
+	}
+	if !reflect.DeepEqual(exports, want) {
+		t.Fatalf("got %q, want %q", exports, want)
+	}
+}
+
+func TestValidateExports(t *testing.T) {
+	tests := []struct {
+		exports map[string]string
+		err     string
+	}{
+		{map[string]string{"OK": "${CLIBS_PACKAGE_DIR}/${CLIBS_BUILD_PROFILE}"}, ""},
+		{map[string]string{"BAD-KEY": "x"}, "invalid variable name"},
+		{map[string]string{"X": "${HOME}/x"}, "unknown variable ${HOME}"},
+		{map[string]string{"X": "$CLIBS_BUILD_DIR/x"}, "bare $"},
+		{map[string]string{"X": "${CLIBS_BUILD_DIR"}, "unterminated"},
+	}
+	for _, tt := range tests {
+		spec := LibSpec{Exports: tt.exports}
+		err := spec.Validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.exports, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want %q", tt.exports, err, tt.err)
+		}
+	}
+}
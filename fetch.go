@@ -1,19 +1,28 @@
 package clibs
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
 // fetchLib fetches the library source based on the configuration
-func (p *Lib) fetchLib() error {
+func (p *Lib) fetchLib(ctx context.Context, config Config) error {
+	log := config.libLogger(p)
+	ctx, cancel := config.stepContext(ctx)
+	defer cancel()
+
 	// Get download directory
-	downloadDir := getDownloadDir(p)
+	downloadDir, err := getDownloadDir(config, p)
+	if err != nil {
+		return err
+	}
 
 	// Temporary download directory for atomic operations
 	downloadTmpDir := downloadDir + "_tmp"
@@ -37,23 +46,21 @@ func (p *Lib) fetchLib() error {
 
 	// Choose download method based on configuration
 	if p.Config.Git != nil && p.Config.Git.Repo != "" {
-		fmt.Printf("  Fetching from git repository: %s\n", p.Config.Git.Repo)
-		fetchErr = fetchFromGit(p.Config.Git, downloadTmpDir)
+		log.debugf("Fetching from git repository: %s", p.Config.Git.Repo)
+		fetchErr = fetchFromGit(ctx, log, p.Config.Git, downloadTmpDir)
 	} else if len(p.Config.Files) > 0 {
-		fmt.Printf("  Fetching from files\n")
-		fetchErr = fetchFromFiles(p.Config.Files, downloadTmpDir, true)
+		log.debugf("Fetching from files")
+		fetchErr = fetchFromFiles(ctx, log, p.Config.Files, downloadTmpDir, true)
 	}
 
 	// If download fails, clean temporary directory and return error
 	if fetchErr != nil {
-		fmt.Printf("  Error fetching library: %v\n", fetchErr)
 		os.RemoveAll(downloadTmpDir)
 		return fetchErr
 	}
 
 	// Write hash file to mark successful download
-	if err := saveHash(downloadTmpDir, p.Config, false); err != nil {
-		fmt.Printf("  Error writing hash file: %v\n", err)
+	if err := saveHash(downloadTmpDir, downloadInputs(p.Config)); err != nil {
 		os.RemoveAll(downloadTmpDir)
 		return err
 	}
@@ -62,7 +69,6 @@ func (p *Lib) fetchLib() error {
 	if _, err := os.Stat(downloadDir); err == nil {
 		// If download directory exists, remove it
 		if err := os.RemoveAll(downloadDir); err != nil {
-			fmt.Printf("  Error removing old download directory: %v\n", err)
 			os.RemoveAll(downloadTmpDir)
 			return err
 		}
@@ -70,7 +76,6 @@ func (p *Lib) fetchLib() error {
 
 	// Rename temporary directory to final directory
 	if err := os.Rename(downloadTmpDir, downloadDir); err != nil {
-		fmt.Printf("  Error renaming temporary directory: %v\n", err)
 		os.RemoveAll(downloadTmpDir)
 		return err
 	}
@@ -79,7 +84,7 @@ func (p *Lib) fetchLib() error {
 }
 
 // fetchFromGit clones a git repository
-func fetchFromGit(gitConfig *GitSpec, downloadDir string) error {
+func fetchFromGit(ctx context.Context, log libLogger, gitConfig *GitSpec, downloadDir string) error {
 	// Prepare git command
 	args := []string{"clone"}
 
@@ -95,12 +100,13 @@ func fetchFromGit(gitConfig *GitSpec, downloadDir string) error {
 	args = append(args, gitConfig.Repo, downloadDir)
 
 	// Execute git command
-	cmd := exec.Command("git", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := commandContext(ctx, "git", args...)
+	output := log.output()
+	cmd.Stdout = output
+	cmd.Stderr = output
 
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("git clone failed: %v", err)
+		return fmt.Errorf("git clone failed: %w\n%s", runError(ctx, err), output.Tail())
 	}
 
 	// Clean .git directory to save space
@@ -113,7 +119,7 @@ func fetchFromGit(gitConfig *GitSpec, downloadDir string) error {
 }
 
 // fetchFromFiles downloads files specified in the configuration
-func fetchFromFiles(files []FileSpec, downloadDir string, clean bool) error {
+func fetchFromFiles(ctx context.Context, log libLogger, files []FileSpec, downloadDir string, clean bool) error {
 	// Clean existing files if requested
 	if clean {
 		dirEntries, err := os.ReadDir(downloadDir)
@@ -150,31 +156,11 @@ func fetchFromFiles(files []FileSpec, downloadDir string, clean bool) error {
 		tmpFilePath := filepath.Join(downloadDir, filename+".download") // Temporary file
 		finalFilePath := filepath.Join(downloadDir, filename)           // Final file location
 
-		fmt.Printf("  Downloading (%d/%d): %s\n", i+1, len(files), file.URL)
+		log.debugf("Downloading (%d/%d): %s", i+1, len(files), file.URL)
 
 		// Download file
-		resp, err := http.Get(file.URL)
-		if err != nil {
-			return fmt.Errorf("download failed: %v", err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("bad status: %s", resp.Status)
-		}
-
-		// Create temporary file
-		out, err := os.Create(tmpFilePath)
-		if err != nil {
-			return fmt.Errorf("failed to create file: %v", err)
-		}
-
-		// Write file content
-		_, err = io.Copy(out, resp.Body)
-		out.Close() // Ensure file is closed even if error occurs
-		if err != nil {
-			os.Remove(tmpFilePath) // Clean up temporary file
-			return fmt.Errorf("failed to write file: %v", err)
+		if err := downloadFile(ctx, file.URL, tmpFilePath, nil); err != nil {
+			return err
 		}
 
 		// Rename temporary file to final location
@@ -194,15 +180,96 @@ func fetchFromFiles(files []FileSpec, downloadDir string, clean bool) error {
 				}
 			}
 
-			fmt.Printf("  Extracting: %s into %s\n", filename, extractDir)
+			log.debugf("Extracting: %s into %s", filename, extractDir)
 			// Extract archive
-			cmd := exec.Command("tar", "-xzf", finalFilePath, "-C", extractDir)
+			cmd := commandContext(ctx, "tar", "-xzf", finalFilePath, "-C", extractDir)
 			output, err := cmd.CombinedOutput()
 			if err != nil {
-				return fmt.Errorf("extraction failed: %v - %s", err, output)
+				return fmt.Errorf("extraction failed: %w - %s", runError(ctx, err), output)
 			}
 		}
 	}
 
 	return nil
 }
+
+// downloadFile downloads url to path, copying file URLs. auth, if not nil,
+// authorizes http requests.
+func downloadFile(ctx context.Context, url, path string, auth func(*http.Request)) error {
+	if src, ok := filePath(url); ok {
+		return copyFile(src, path)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	if auth != nil {
+		auth(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{Status: resp.Status, Code: resp.StatusCode}
+	}
+
+	// Create temporary file
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+
+	// Write file content
+	_, err = io.Copy(out, resp.Body)
+	out.Close() // Ensure file is closed even if error occurs
+	if err != nil {
+		os.Remove(path) // Clean up temporary file
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// statusError is returned by downloadFile for unexpected HTTP responses
+type statusError struct {
+	Status string
+	Code   int
+}
+
+func (e *statusError) Error() string {
+	return "bad status: " + e.Status
+}
+
+// isNotFound reports whether a download failed because the file does not
+// exist, as opposed to a network or server error
+func isNotFound(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.Code == http.StatusNotFound
+	}
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// copyFile copies the file at src to path
+func copyFile(src, path string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer in.Close()
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package clibs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PackageFlags are the flags LLGo derives from the LLGoPackage and
+// LLGoFiles constants of a package of a lib
+type PackageFlags struct {
+	ImportPath string `json:"importPath"`
+	Lib        string `json:"lib"`
+	// LLGoPackage and LLGoFiles are the constants as declared
+	LLGoPackage string   `json:"llgoPackage,omitempty"`
+	LLGoFiles   string   `json:"llgoFiles,omitempty"`
+	CFlags      []string `json:"cflags,omitempty"`
+	LDFlags     []string `json:"ldflags,omitempty"`
+}
+
+// LLGoFlags are the flags of the packages of libs for a target
+type LLGoFlags struct {
+	Goos     string         `json:"goos"`
+	Goarch   string         `json:"goarch"`
+	Packages []PackageFlags `json:"packages"`
+	// CFlags are in the dependency order of the packages and LDFlags in the
+	// reverse order as linkers require
+	CFlags  []string `json:"cflags"`
+	LDFlags []string `json:"ldflags"`
+}
+
+// LLGo lists the packages matched by patterns and their dependencies for
+// the target of config, and expands the LLGoPackage and LLGoFiles
+// constants of those in libs against the env of their lib, as LLGo does
+// when linking. Like Export, libs must have been built for the target.
+func LLGo(ctx context.Context, config Config, libs []*Lib, patterns ...string) (*LLGoFlags, error) {
+	config = config.buildDefaults()
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	pkgs, err := listTargetPkgs(ctx, config, patterns)
+	if err != nil {
+		return nil, newError(nil, "", PhaseList, err)
+	}
+
+	byMod := make(map[string]*Lib)
+	for _, lib := range libs {
+		byMod[lib.ModName] = lib
+	}
+
+	// Collect the constants first, the env of every lib is needed to run
+	// pkg-config in any of them
+	var result []PackageFlags
+	var used []*Lib
+	seen := make(map[*Lib]bool)
+	for _, pkg := range pkgs {
+		lib := byMod[pkg.Module.Path]
+		if lib == nil {
+			continue
+		}
+		consts, err := readLLGoConsts(pkg.Dir, pkg.GoFiles)
+		if err != nil {
+			return nil, newError(lib, targetTriple, PhaseExport, fmt.Errorf("%s: %v", pkg.ImportPath, err))
+		}
+		if consts["LLGoPackage"] == "" && consts["LLGoFiles"] == "" {
+			continue
+		}
+		if !seen[lib] {
+			if err := lib.resolveEnv(config); err != nil {
+				return nil, newError(lib, targetTriple, PhaseExport, err)
+			}
+			seen[lib] = true
+			used = append(used, lib)
+		}
+		result = append(result, PackageFlags{
+			ImportPath:  pkg.ImportPath,
+			Lib:         lib.ModName,
+			LLGoPackage: consts["LLGoPackage"],
+			LLGoFiles:   consts["LLGoFiles"],
+		})
+	}
+
+	pcPath, err := pkgConfigPathVar(config, used)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := &LLGoFlags{Goos: config.Goos, Goarch: config.Goarch, Packages: result}
+	for i := range result {
+		p := &result[i]
+		lib := byMod[p.Lib]
+		env := append([]string{}, lib.Env...)
+		if pcPath.Value != "" {
+			env = append(env, pcPath.Key+"="+pcPath.Value)
+		}
+		if p.LDFlags, err = llgoLinkFlags(ctx, config, lib, env, p.LLGoPackage); err != nil {
+			return nil, newError(lib, targetTriple, PhaseExport, fmt.Errorf("%s: LLGoPackage: %v", p.ImportPath, err))
+		}
+		if p.CFlags, err = llgoFilesCFlags(ctx, config, lib, env, p.LLGoFiles); err != nil {
+			return nil, newError(lib, targetTriple, PhaseExport, fmt.Errorf("%s: LLGoFiles: %v", p.ImportPath, err))
+		}
+		flags.CFlags = append(flags.CFlags, p.CFlags...)
+	}
+	for i := len(result) - 1; i >= 0; i-- {
+		flags.LDFlags = append(flags.LDFlags, result[i].LDFlags...)
+	}
+	return flags, nil
+}
+
+// listTargetPkgs lists the packages matched by patterns and their
+// dependencies, dependencies first, with the build constraints of the
+// target of config
+func listTargetPkgs(ctx context.Context, config Config, patterns []string) ([]pkgInfo, error) {
+	ctx, cancel := config.stepContext(ctx)
+	defer cancel()
+
+	args := append([]string{"list", "-json", "-deps"}, config.Tags...)
+	args = append(args, patterns...)
+	config.libLogger(nil).debugf("Executing: GOOS=%s GOARCH=%s go %s", config.Goos, config.Goarch, strings.Join(args, " "))
+	cmd := commandContext(ctx, "go", args...)
+	cmd.Dir = config.Dir
+	cmd.Env = append(os.Environ(), "GOOS="+config.Goos, "GOARCH="+config.Goarch)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to list specified packages: %w\n%s", runError(ctx, err), stderr.String())
+	}
+
+	var pkgs []pkgInfo
+	decoder := json.NewDecoder(&stdout)
+	for decoder.More() {
+		var pkg pkgInfo
+		if err := decoder.Decode(&pkg); err != nil {
+			return nil, fmt.Errorf("error parsing package info: %v", err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// readLLGoConsts returns the string constants LLGoPackage and LLGoFiles
+// declared in the Go files of a package
+func readLLGoConsts(dir string, goFiles []string) (map[string]string, error) {
+	consts := make(map[string]string)
+	fset := token.NewFileSet()
+	for _, name := range goFiles {
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, ident := range vs.Names {
+					if ident.Name != "LLGoPackage" && ident.Name != "LLGoFiles" || i >= len(vs.Values) {
+						continue
+					}
+					lit, ok := vs.Values[i].(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						return nil, fmt.Errorf("%s: %s is not a string literal", fset.Position(ident.Pos()), ident.Name)
+					}
+					value, err := strconv.Unquote(lit.Value)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %v", fset.Position(lit.Pos()), err)
+					}
+					consts[ident.Name] = value
+				}
+			}
+		}
+	}
+	return consts, nil
+}
+
+// llgoLinkFlags returns the flags of a "link: ..." LLGoPackage. Like LLGo,
+// the first of the ';' separated alternatives that expands to any flags
+// wins. Other kinds of packages have no flags.
+func llgoLinkFlags(ctx context.Context, config Config, lib *Lib, env []string, param string) ([]string, error) {
+	param, ok := strings.CutPrefix(strings.TrimSpace(param), "link:")
+	if !ok {
+		return nil, nil
+	}
+	for _, alt := range strings.Split(param, ";") {
+		expanded, err := expandLLGo(ctx, config, lib, env, alt)
+		if err != nil {
+			return nil, err
+		}
+		if fields := strings.Fields(expanded); len(fields) > 0 {
+			return fields, nil
+		}
+	}
+	return nil, nil
+}
+
+// llgoFilesCFlags returns the flags before the ':' of an LLGoFiles of the
+// form "cflags: file1; file2"
+func llgoFilesCFlags(ctx context.Context, config Config, lib *Lib, env []string, param string) ([]string, error) {
+	pos := strings.IndexByte(param, ':')
+	if pos <= 0 {
+		return nil, nil
+	}
+	expanded, err := expandLLGo(ctx, config, lib, env, param[:pos])
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(expanded), nil
+}
+
+// expandLLGo expands $(command), ${VAR} and $VAR in s, looking variables
+// up in env and then the environment. Unset variables expand to nothing
+// and commands run in the lib dir, as LLGo expands them.
+func expandLLGo(ctx context.Context, config Config, lib *Lib, env []string, s string) (string, error) {
+	lookup := func(name string) string {
+		if v := envValue(env, name); v != "" {
+			return v
+		}
+		return os.Getenv(name)
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "$(")
+		if start < 0 {
+			b.WriteString(os.Expand(s, lookup))
+			return b.String(), nil
+		}
+		b.WriteString(os.Expand(s[:start], lookup))
+		end, depth := -1, 0
+		for i := start + 2; i < len(s) && end < 0; i++ {
+			switch s[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					end = i
+				}
+				depth--
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated $( in %q", s)
+		}
+		output, err := runLLGoCommand(ctx, config, lib, env, s[start+2:end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(output)
+		s = s[end+1:]
+	}
+}
+
+// runLLGoCommand runs a $(command) of expandLLGo and returns its output
+func runLLGoCommand(ctx context.Context, config Config, lib *Lib, env []string, command string) (string, error) {
+	ctx, cancel := config.stepContext(ctx)
+	defer cancel()
+	cmd := commandContext(ctx, "bash", "-c", command)
+	cmd.Dir = lib.Path
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("$(%s) failed: %w\n%s", command, runError(ctx, err), stderr.String())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
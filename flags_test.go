@@ -0,0 +1,72 @@
+package clibs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLLGo(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"app/go.mod": `module example.com/app
+
+go 1.21
+
+require example.com/top v0.0.0
+
+require example.com/base v0.0.0 // indirect
+
+replace example.com/top => ../top
+
+replace example.com/base => ../base
+`,
+		"app/main.go":      "package main\n\nimport _ \"example.com/top\"\n\nfunc main() {}\n",
+		"base/go.mod":      "module example.com/base\n\ngo 1.21\n",
+		"base/base.go":     "package base\n\nconst LLGoPackage = \"link: $CLIBS_UNSET_LIB; -L${CLIBS_BUILD_DIR}/lib -lbase\"\n",
+		"top/go.mod":       "module example.com/top\n\ngo 1.21\n\nrequire example.com/base v0.0.0\n\nreplace example.com/base => ../base\n",
+		"top/top.go":       "package top\n\nimport _ \"example.com/base\"\n\nconst LLGoFiles = \"$(echo -I$CLIBS_BUILD_DIR/include): top.c\"\n",
+		"top/top_linux.go": "package top\n\nconst LLGoPackage = \"link: -L${CLIBS_BUILD_DIR}/lib -ltop\"\n",
+		"top/top_other.go": "//go:build !linux\n\npackage top\n\nconst LLGoPackage = \"link: -lother\"\n",
+	}
+	writeTestFiles(t, root, files)
+
+	config := Config{Goos: "linux", Goarch: "amd64", Dir: filepath.Join(root, "app"), CacheDir: t.TempDir(), Logger: Discard}
+	base := &Lib{ModName: "example.com/base", Path: filepath.Join(root, "base"), Config: LibSpec{Name: "base"}}
+	top := &Lib{ModName: "example.com/top", Path: filepath.Join(root, "top"), Config: LibSpec{Name: "top"}}
+	libs := []*Lib{base, top}
+
+	ctx := context.Background()
+	if _, err := LLGo(ctx, config, libs, "."); !errors.Is(err, ErrNotBuilt) {
+		t.Fatalf("LLGo before build: got %v, want ErrNotBuilt", err)
+	}
+	if err := BuildContext(ctx, config, libs); err != nil {
+		t.Fatal(err)
+	}
+	base.Env, top.Env = nil, nil
+
+	flags, err := LLGo(ctx, config, libs, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := getTargetTriple("linux", "amd64")
+	baseDir := filepath.Join(base.Path, BuildDirName, target)
+	topDir := filepath.Join(top.Path, BuildDirName, target)
+	wantCFlags := []string{"-I" + topDir + "/include"}
+	wantLDFlags := []string{"-L" + topDir + "/lib", "-ltop", "-L" + baseDir + "/lib", "-lbase"}
+	if !reflect.DeepEqual(flags.CFlags, wantCFlags) {
+		t.Errorf("CFlags = %q, want %q", flags.CFlags, wantCFlags)
+	}
+	if !reflect.DeepEqual(flags.LDFlags, wantLDFlags) {
+		t.Errorf("LDFlags = %q, want %q", flags.LDFlags, wantLDFlags)
+	}
+	var pkgs []string
+	for _, pkg := range flags.Packages {
+		pkgs = append(pkgs, pkg.ImportPath)
+	}
+	if want := []string{"example.com/base", "example.com/top"}; !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("packages = %q, want %q", pkgs, want)
+	}
+}
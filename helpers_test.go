@@ -0,0 +1,22 @@
+package clibs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFiles writes files, keyed by their slash separated path, under
+// root
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
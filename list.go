@@ -2,16 +2,26 @@ package clibs
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// ListCacheDirName is the dir of the cache holding the modules found by
+// ListLibs, keyed by the project files, build tags and patterns. PruneCache
+// removes the lists not used within PruneOptions.UnusedFor.
+const ListCacheDirName = ".list"
+
 // libInfo represents the JSON output from go list -m -json
 type libInfo struct {
 	Path    string
@@ -24,6 +34,7 @@ type libInfo struct {
 type pkgInfo struct {
 	ImportPath string
 	Dir        string
+	GoFiles    []string
 	Module     struct {
 		Path    string
 		Version string
@@ -35,23 +46,315 @@ type pkgInfo struct {
 // ListLibs gets all C libraries from the current project dependencies
 // tags: e.g. []string{"-tags", "linux,amd64"}
 func ListLibs(tags []string, patterns ...string) ([]*Lib, error) {
-	// Get module paths
-	mods, err := listMods(tags, patterns)
+	return ListLibsContext(context.Background(), Config{Tags: tags}, patterns...)
+}
+
+// ListLibsContext is like ListLibs, taking build tags from config.Tags and
+// killing go list when ctx is done. The modules found are cached by the
+// go.mod, go.sum and build tags of the project, see listModsCached.
+func ListLibsContext(ctx context.Context, config Config, patterns ...string) ([]*Lib, error) {
+	log := config.libLogger(nil)
+	ctx, cancel := config.stepContext(ctx)
+	defer cancel()
+
+	// Get modules with their dirs and sums
+	mods, err := config.listModsCached(ctx, log, patterns)
 	if err != nil {
-		return nil, err
+		return nil, newError(nil, "", PhaseList, err)
 	}
 
 	// Process modules to find lib.yaml files
-	return findLibs(tags, mods)
+	return findLibs(log, mods), nil
+}
+
+// listModsCached is like listMods, reusing the result of a previous call
+// with the same project files, build tags, patterns and go environment.
+// Setting $CLIBS_NO_LIST_CACHE to 1 disables the cache.
+func (c Config) listModsCached(ctx context.Context, log libLogger, patterns []string) ([]libInfo, error) {
+	path, ok := c.listCacheFile(patterns)
+	if !ok {
+		return listMods(ctx, log, c.Dir, c.Tags, patterns)
+	}
+	if mods, ok := readListCache(path); ok {
+		log.debugf("Using cached module list: %s", path)
+		return mods, nil
+	}
+	mods, err := listMods(ctx, log, c.Dir, c.Tags, patterns)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeListCache(path, mods); err != nil {
+		log.warnf("Failed to cache module list: %v", err)
+	}
+	return mods, nil
+}
+
+// listCacheKey identifies the result of listMods
+type listCacheKey struct {
+	Dir      string            `json:"dir"`
+	Patterns []string          `json:"patterns"`
+	Tags     []string          `json:"tags"`
+	Files    map[string]string `json:"files"`
+	// Sources are the size and mtime of the Go files of the project, new
+	// packages and changed imports list again
+	Sources map[string]string `json:"sources"`
+	// Local are the Sources and go.mod of the local modules the project
+	// replaces or uses in its workspace, keyed by their dir
+	Local map[string]map[string]string `json:"local,omitempty"`
+	Env   map[string]string            `json:"env"`
+	Tool  string                       `json:"tool"`
+}
+
+// listCacheFile returns the cache file of listMods for patterns, or false
+// if the project has no go.mod or caching is disabled
+func (c Config) listCacheFile(patterns []string) (string, bool) {
+	if os.Getenv(EnvNoListCache) == "1" {
+		return "", false
+	}
+	root, ok := c.projectRoot()
+	if !ok {
+		return "", false
+	}
+	dir, err := filepath.Abs(c.Dir)
+	if err != nil {
+		return "", false
+	}
+	key := listCacheKey{
+		Dir:      dir,
+		Patterns: patterns,
+		Tags:     c.Tags,
+		Files:    make(map[string]string),
+		Env:      make(map[string]string),
+		Tool:     toolVersion(),
+	}
+	for _, name := range []string{"go.mod", "go.sum", "go.work", "go.work.sum", "vendor/modules.txt"} {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", false
+		}
+		sum := sha256.Sum256(content)
+		key.Files[name] = hex.EncodeToString(sum[:])
+	}
+	if key.Sources, err = projectSources(root); err != nil {
+		return "", false
+	}
+	if key.Local, err = localSources(root); err != nil {
+		return "", false
+	}
+	for _, name := range []string{"GOOS", "GOARCH", "GOFLAGS", "GOWORK", "GOPATH", "GOMODCACHE"} {
+		key.Env[name] = os.Getenv(name)
+	}
+	digest, err := digestOf(key)
+	if err != nil {
+		return "", false
+	}
+	cacheRoot, err := c.cacheRoot()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(cacheRoot, ListCacheDirName, strings.TrimPrefix(digest, "sha256:")+".json"), true
 }
 
-// listMods gets modules from specified package patterns
-func listMods(tags []string, patterns []string) ([]string, error) {
+// projectSources returns the size and mtime of every Go file of the module
+// at root, skipping the dirs go ignores, vendor and nested modules
+func projectSources(root string) (map[string]string, error) {
+	sources := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == root {
+				return nil
+			}
+			name := d.Name()
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sources[filepath.ToSlash(rel)] = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return sources, err
+}
+
+// localSources returns the sources and go.mod of the local modules of the
+// project at root, whose Go files go list reads like those of the project
+func localSources(root string) (map[string]map[string]string, error) {
+	dirs, err := localModuleDirs(root)
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]map[string]string)
+	for _, dir := range dirs {
+		sources, err := projectSources(dir)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(filepath.Join(dir, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		sources["go.mod"] = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+		local[dir] = sources
+	}
+	return local, nil
+}
+
+// localModuleDirs returns the dirs of the modules used by the go.work at
+// root and of the local replacements in the go.mod of root and of those
+// modules
+func localModuleDirs(root string) ([]string, error) {
+	seen := map[string]bool{root: true}
+	var dirs []string
+	add := func(dir string, paths []string) {
+		for _, path := range paths {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			if !seen[path] {
+				seen[path] = true
+				dirs = append(dirs, path)
+			}
+		}
+	}
+	uses, err := readDirectives(filepath.Join(root, "go.work"), "use")
+	if err != nil {
+		return nil, err
+	}
+	add(root, uses)
+	for _, mod := range append([]string{root}, dirs...) {
+		replaces, err := readDirectives(filepath.Join(mod, "go.mod"), "replace")
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, replace := range replaces {
+			_, target, ok := strings.Cut(replace, "=>")
+			if fields := strings.Fields(target); ok && len(fields) == 1 && isLocalPath(unquote(fields[0])) {
+				paths = append(paths, filepath.FromSlash(unquote(fields[0])))
+			}
+		}
+		add(mod, paths)
+	}
+	return dirs, nil
+}
+
+// readDirectives returns the arguments of the verb directives of a go.mod
+// or go.work file, in line and block form. A missing file has none.
+func readDirectives(path, verb string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var args []string
+	inBlock := false
+	for _, line := range strings.Split(string(content), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		line = strings.TrimSpace(line)
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+		case inBlock && line != "":
+			args = append(args, unquote(line))
+		case line == verb+" (":
+			inBlock = true
+		case strings.HasPrefix(line, verb+" "):
+			args = append(args, unquote(strings.TrimSpace(strings.TrimPrefix(line, verb))))
+		}
+	}
+	return args, nil
+}
+
+// isLocalPath reports whether a replacement is a dir rather than a module
+// path, as go decides it
+func isLocalPath(path string) bool {
+	return filepath.IsAbs(path) || path == "." || path == ".." ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") ||
+		strings.HasPrefix(path, `.\`) || strings.HasPrefix(path, `..\`)
+}
+
+// unquote removes the quotes of a quoted path
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// readListCache reads a cached module list, which is stale if any module
+// dir is gone. A hit updates the mtime PruneCache ages lists out by.
+func readListCache(path string) ([]libInfo, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var mods []libInfo
+	if err := json.Unmarshal(data, &mods); err != nil {
+		return nil, false
+	}
+	for _, mod := range mods {
+		if _, err := os.Stat(mod.Dir); err != nil {
+			return nil, false
+		}
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return mods, true
+}
+
+// writeListCache writes a module list to path atomically
+func writeListCache(path string, mods []libInfo) error {
+	data, err := json.Marshal(mods)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// listMods gets the modules of the packages matched by patterns and their
+// dependencies, with the dirs and sums from the same go list call
+func listMods(ctx context.Context, log libLogger, dir string, tags []string, patterns []string) ([]libInfo, error) {
 	// Use go list -json -deps to get package info and all dependencies
 	args := append([]string{"list", "-json", "-deps"}, tags...)
 	args = append(args, patterns...)
-	fmt.Printf("Executing: go %s\n", strings.Join(args, " "))
-	cmd := exec.Command("go", args...)
+	log.debugf("Executing: go %s", strings.Join(args, " "))
+	cmd := commandContext(ctx, "go", args...)
+	cmd.Dir = dir
 
 	// Capture both stdout and stderr
 	var stdout, stderr bytes.Buffer
@@ -60,23 +363,71 @@ func listMods(tags []string, patterns []string) ([]string, error) {
 
 	err := cmd.Run()
 	if err != nil {
-		// Print stderr if available
-		if stderr.Len() > 0 {
-			fmt.Printf("Error output: %s\n", stderr.String())
+		// Include stderr if available
+		return nil, fmt.Errorf("failed to list specified packages: %w\n%s", runError(ctx, err), stderr.String())
+	}
+
+	mods := parseJSON(log, stdout.Bytes())
+
+	// Modules without a dir in the package info, e.g. when vendoring, are
+	// resolved by a single go list -m call
+	var missing []string
+	for _, mod := range mods {
+		if mod.Dir == "" {
+			missing = append(missing, mod.Path)
 		}
-		return nil, fmt.Errorf("failed to list specified packages: %v", err)
+	}
+	if len(missing) == 0 {
+		return mods, nil
+	}
+	infos, err := listModInfo(ctx, log, dir, tags, missing)
+	if err != nil {
+		return nil, err
+	}
+	for i, mod := range mods {
+		if info, ok := infos[mod.Path]; ok {
+			mods[i] = info
+		}
+	}
+	return mods, nil
+}
+
+// listModInfo gets the info of mods with one go list -m -json call
+func listModInfo(ctx context.Context, log libLogger, dir string, tags []string, mods []string) (map[string]libInfo, error) {
+	args := append(append([]string{"list", "-m", "-json"}, tags...), mods...)
+	log.debugf("Executing: go %s", strings.Join(args, " "))
+	cmd := commandContext(ctx, "go", args...)
+	cmd.Dir = dir
+
+	// Capture both stdout and stderr
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// Include stderr if available
+		return nil, fmt.Errorf("error finding module info: %w\n%s", runError(ctx, err), stderr.String())
 	}
 
-	return parseJSON(stdout.Bytes())
+	infos := make(map[string]libInfo)
+	decoder := json.NewDecoder(&stdout)
+	for decoder.More() {
+		var info libInfo
+		if err := decoder.Decode(&info); err != nil {
+			return nil, fmt.Errorf("error parsing module info: %v", err)
+		}
+		infos[info.Path] = info
+	}
+	return infos, nil
 }
 
-// parseJSON parses module paths from JSON output
-func parseJSON(data []byte) ([]string, error) {
-	var mods []string
+// parseJSON parses the modules of packages from JSON output
+func parseJSON(log libLogger, data []byte) []libInfo {
+	var mods []libInfo
 
 	// Parse JSON output
 	// go list -json outputs a series of JSON objects separated by newlines
-	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder := json.NewDecoder(bytes.NewReader(data))
 
 	// Track processed modules to avoid duplicates
 	seen := make(map[string]bool)
@@ -84,28 +435,33 @@ func parseJSON(data []byte) ([]string, error) {
 	for decoder.More() {
 		var pkg pkgInfo
 		if err := decoder.Decode(&pkg); err != nil {
-			fmt.Printf("Error parsing package info: %v\n", err)
-			continue
+			log.warnf("Error parsing package info: %v", err)
+			break
 		}
 
 		// If package has an associated module and we haven't processed it yet
 		if pkg.Module.Path != "" && !seen[pkg.Module.Path] {
-			mods = append(mods, pkg.Module.Path)
+			mods = append(mods, libInfo{
+				Path:    pkg.Module.Path,
+				Version: pkg.Module.Version,
+				Dir:     pkg.Module.Dir,
+				Sum:     pkg.Module.Sum,
+			})
 			seen[pkg.Module.Path] = true
 		}
 	}
 
-	return mods, nil
+	return mods
 }
 
 // findLibs processes modules to find lib.yaml files
-func findLibs(tags []string, mods []string) ([]*Lib, error) {
+func findLibs(log libLogger, mods []libInfo) []*Lib {
 	var libs []*Lib
 
 	for _, mod := range mods {
-		lib, found, err := processLib(tags, mod)
+		lib, found, err := processLib(log, mod)
 		if err != nil {
-			fmt.Printf("Error processing module %s: %v\n", mod, err)
+			log.warnf("Error processing module %s: %v", mod.Path, err)
 			continue
 		}
 
@@ -114,34 +470,11 @@ func findLibs(tags []string, mods []string) ([]*Lib, error) {
 		}
 	}
 
-	return libs, nil
+	return libs
 }
 
 // processLib processes a single module to find lib.yaml
-func processLib(tags []string, mod string) (*Lib, bool, error) {
-	// Get detailed module info including Sum field
-	cmd := exec.Command("go", append(append([]string{"list", "-m", "-json"}, tags...), mod)...)
-
-	// Capture both stdout and stderr
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		// Print stderr if available
-		if stderr.Len() > 0 {
-			fmt.Printf("Error output for module %s: %s\n", mod, stderr.String())
-		}
-		return nil, false, fmt.Errorf("error finding module info: %v", err)
-	}
-
-	// Parse module info
-	var info libInfo
-	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
-		return nil, false, fmt.Errorf("error parsing module info: %v", err)
-	}
-
+func processLib(log libLogger, info libInfo) (*Lib, bool, error) {
 	dir := info.Dir
 	if dir == "" {
 		return nil, false, fmt.Errorf("no local path found")
@@ -149,7 +482,7 @@ func processLib(tags []string, mod string) (*Lib, bool, error) {
 
 	// Check if lib.yaml exists
 	yamlPath := filepath.Join(dir, "lib.yaml")
-	fmt.Printf("  Checking for lib.yaml: %s\n", yamlPath)
+	log.debugf("Checking for lib.yaml: %s", yamlPath)
 	if _, err := os.Stat(yamlPath); err != nil {
 		// lib.yaml doesn't exist
 		return nil, false, nil
@@ -157,7 +490,7 @@ func processLib(tags []string, mod string) (*Lib, bool, error) {
 
 	// Create lib object
 	lib := &Lib{
-		ModName: mod,
+		ModName: info.Path,
 		Path:    dir,
 		Sum:     info.Sum,
 	}
@@ -173,9 +506,12 @@ func processLib(tags []string, mod string) (*Lib, bool, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, false, fmt.Errorf("error parsing YAML: %v", err)
 	}
+	if err := config.Validate(); err != nil {
+		return nil, false, fmt.Errorf("invalid %s: %v", yamlPath, err)
+	}
 
-	fmt.Printf("  Found lib.yaml: %s at %s\n", mod, yamlPath)
-	fmt.Printf("  Config: %v\n", config)
+	log.debugf("Found lib.yaml: %s at %s", info.Path, yamlPath)
+	log.debugf("Config: %+v", config)
 	lib.Config = config
 
 	return lib, true, nil
@@ -0,0 +1,123 @@
+package clibs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListLibsCache(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"app/go.mod":   "module example.com/app\n\ngo 1.21\n\nrequire example.com/foo v0.0.0\n\nreplace example.com/foo => ../foo\n",
+		"app/main.go":  "package main\n\nimport _ \"example.com/foo\"\n\nfunc main() {}\n",
+		"foo/go.mod":   "module example.com/foo\n\ngo 1.21\n",
+		"foo/foo.go":   "package foo\n",
+		"foo/lib.yaml": "name: foo\nversion: 1.0.0\n",
+	}
+	writeTestFiles(t, root, files)
+	t.Setenv(EnvNoListCache, "")
+
+	ctx := context.Background()
+	config := Config{Dir: filepath.Join(root, "app"), CacheDir: t.TempDir(), Logger: Discard}
+	libs, err := ListLibsContext(ctx, config, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libs) != 1 || libs[0].ModName != "example.com/foo" || libs[0].Path != filepath.Join(root, "foo") || libs[0].Config.Name != "foo" {
+		t.Fatalf("unexpected libs %+v", libs)
+	}
+	if _, err := ListLibsContext(ctx, config, "./..."); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without go in PATH, only the cached result can be used
+	t.Setenv("PATH", "")
+	for _, pattern := range []string{".", "./..."} {
+		libs, err = ListLibsContext(ctx, config, pattern)
+		if err != nil {
+			t.Fatalf("cached list of %s failed: %v", pattern, err)
+		}
+		if len(libs) != 1 || libs[0].Config.Name != "foo" {
+			t.Fatalf("unexpected cached libs of %s: %+v", pattern, libs)
+		}
+	}
+
+	// New packages and changed imports list again
+	subFile := filepath.Join(root, "app", "sub", "sub.go")
+	writeTestFiles(t, root, map[string]string{"app/sub/sub.go": "package sub\n"})
+	if _, err := ListLibsContext(ctx, config, "./..."); err == nil {
+		t.Fatal("list after adding a package used the cache")
+	}
+	os.Remove(subFile)
+	mainFile := filepath.Join(root, "app", "main.go")
+	if err := os.WriteFile(mainFile, []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListLibsContext(ctx, config, "."); err == nil {
+		t.Fatal("list after changing imports used the cache")
+	}
+	if err := os.WriteFile(mainFile, []byte(files["app/main.go"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// So do changed imports of the replaced module
+	fooFile := filepath.Join(root, "foo", "foo.go")
+	if err := os.WriteFile(fooFile, []byte("package foo\n\nimport _ \"fmt\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListLibsContext(ctx, config, "."); err == nil {
+		t.Fatal("list after changing imports of a replaced module used the cache")
+	}
+	if err := os.WriteFile(fooFile, []byte(files["foo/foo.go"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other tags and changes of go.mod list again
+	tagged := config
+	tagged.Tags = []string{"-tags", "x"}
+	if _, err := ListLibsContext(ctx, tagged, "."); err == nil {
+		t.Fatal("list with other tags used the cache")
+	}
+	goMod := filepath.Join(root, "app", "go.mod")
+	if err := os.WriteFile(goMod, []byte(files["app/go.mod"]+"\n// changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListLibsContext(ctx, config, "."); err == nil {
+		t.Fatal("list after changing go.mod used the cache")
+	}
+
+	t.Setenv(EnvNoListCache, "1")
+	if err := os.WriteFile(goMod, []byte(files["app/go.mod"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListLibsContext(ctx, config, "."); err == nil {
+		t.Fatalf("list used the cache with $%s set", EnvNoListCache)
+	}
+}
+
+func TestLocalModuleDirs(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"go.work":      "go 1.21\n\nuse (\n\t.\n\t./tools // tools\n)\nuse \"./extra\"\n",
+		"go.mod":       "module example.com/app\n\nreplace example.com/a => ../a\n\nreplace (\n\texample.com/b v1.0.0 => ./b\n\texample.com/c => example.com/d v1.0.0\n)\n",
+		"tools/go.mod": "module example.com/tools\n\nreplace example.com/e => ../e\n",
+		"extra/go.mod": "module example.com/extra\n",
+	})
+	dirs, err := localModuleDirs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(root, "tools"),
+		filepath.Join(root, "extra"),
+		filepath.Join(filepath.Dir(root), "a"),
+		filepath.Join(root, "b"),
+		filepath.Join(root, "e"),
+	}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Fatalf("got %v, want %v", dirs, want)
+	}
+}
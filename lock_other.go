@@ -0,0 +1,11 @@
+//go:build !unix
+
+package clibs
+
+import "context"
+
+// lockFile does not lock. The store needs symlinks, which other platforms
+// rarely allow, and a build is only linked once its state is saved.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,200 @@
+package clibs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log event
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Event is a single log record
+type Event struct {
+	Time   time.Time `json:"time"`
+	Level  Level     `json:"level"`
+	Lib    string    `json:"lib,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Msg    string    `json:"msg"`
+}
+
+// Logger receives the progress and diagnostics of the library
+type Logger interface {
+	Log(e Event)
+}
+
+// Discard drops every event
+var Discard Logger = discardLogger{}
+
+type discardLogger struct{}
+
+func (discardLogger) Log(Event) {}
+
+// NewTextLogger writes events at or above level as plain text lines
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &textLogger{w: w, level: level}
+}
+
+type textLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+func (l *textLogger) Log(e Event) {
+	if e.Level < l.level {
+		return
+	}
+	var b strings.Builder
+	if e.Level >= LevelWarn {
+		b.WriteString(e.Level.String())
+		b.WriteString(": ")
+	}
+	if e.Lib != "" {
+		b.WriteString(e.Lib)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Msg)
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+// NewJSONLogger writes events at or above level as JSON lines
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &jsonLogger{enc: json.NewEncoder(w), level: level}
+}
+
+type jsonLogger struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	level Level
+}
+
+func (l *jsonLogger) Log(e Event) {
+	if e.Level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// logger returns config.Logger, defaulting to text on stderr
+func (c Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	if c.Verbose {
+		return NewTextLogger(os.Stderr, LevelDebug)
+	}
+	return NewTextLogger(os.Stderr, LevelInfo)
+}
+
+// libLogger attaches the lib and target to events
+type libLogger struct {
+	Logger
+	lib    string
+	target string
+}
+
+// libLogger returns a logger for lib, lib may be nil
+func (c Config) libLogger(lib *Lib) libLogger {
+	l := libLogger{Logger: c.logger()}
+	if lib != nil {
+		l.lib = lib.ModName
+		l.target = getTargetTriple(c.Goos, c.Goarch)
+	}
+	return l
+}
+
+func (l libLogger) logf(level Level, format string, args ...any) {
+	l.Log(Event{
+		Time:   time.Now(),
+		Level:  level,
+		Lib:    l.lib,
+		Target: l.target,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (l libLogger) debugf(format string, args ...any) { l.logf(LevelDebug, format, args...) }
+func (l libLogger) infof(format string, args ...any)  { l.logf(LevelInfo, format, args...) }
+func (l libLogger) warnf(format string, args ...any)  { l.logf(LevelWarn, format, args...) }
+
+// outputTailLines is how much child process output is kept for errors
+const outputTailLines = 30
+
+// outputWriter forwards child process output to the logger line by line
+// at debug level, keeping the last lines for error reports.
+type outputWriter struct {
+	log  libLogger
+	buf  []byte
+	tail []string
+}
+
+func (l libLogger) output() *outputWriter {
+	return &outputWriter{log: l}
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *outputWriter) line(s string) {
+	s = strings.TrimRight(s, "\r")
+	w.log.debugf("%s", s)
+	w.tail = append(w.tail, s)
+	if len(w.tail) > outputTailLines {
+		w.tail = w.tail[1:]
+	}
+}
+
+// Tail returns the last lines of output
+func (w *outputWriter) Tail() string {
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+	return strings.Join(w.tail, "\n")
+}
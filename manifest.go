@@ -0,0 +1,201 @@
+package clibs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestFile lists every file produced by a build or prebuilt extraction
+const ManifestFile = "_llgo_clib_manifest.json"
+
+const manifestVersion = 1
+
+// ErrNoManifest is returned when a directory has no manifest file
+var ErrNoManifest = errors.New("manifest not found")
+
+// ManifestEntry describes a single produced file
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// Manifest is the content of ManifestFile
+type Manifest struct {
+	Version int             `json:"version"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+// isStateFile reports whether name is bookkeeping written by clibs itself
+func isStateFile(name string) bool {
+	return name == BuildHashFile || name == ManifestFile || name == VerificationFile
+}
+
+// WriteManifest records size and sha256 of every file in dir
+func WriteManifest(dir string) (*Manifest, error) {
+	manifest := &Manifest{Version: manifestVersion}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if isStateFile(rel) {
+			return nil
+		}
+		entry := ManifestEntry{Path: filepath.ToSlash(rel)}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else {
+			if entry.Size, entry.Sha256, err = fileDigest(path); err != nil {
+				return err
+			}
+		}
+		manifest.Files = append(manifest.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", dir, err)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), content, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadManifest reads the manifest in dir
+func ReadManifest(dir string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoManifest
+		}
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %v", dir, err)
+	}
+	return &manifest, nil
+}
+
+// VerifyManifest checks the files in dir against its manifest. The fast
+// check compares sizes only, full also compares sha256 digests.
+func VerifyManifest(dir string, full bool) error {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, entry := range manifest.Files {
+		path := filepath.Join(dir, filepath.FromSlash(entry.Path))
+		if entry.Link != "" {
+			if link, err := os.Readlink(path); err != nil || link != entry.Link {
+				problems = append(problems, fmt.Sprintf("%s: link changed", entry.Path))
+			}
+			continue
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: missing", entry.Path))
+			continue
+		}
+		if fi.Size() != entry.Size {
+			problems = append(problems, fmt.Sprintf("%s: size %d, want %d", entry.Path, fi.Size(), entry.Size))
+			continue
+		}
+		if full {
+			if _, sum, err := fileDigest(path); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", entry.Path, err))
+			} else if sum != entry.Sha256 {
+				problems = append(problems, fmt.Sprintf("%s: sha256 mismatch", entry.Path))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d corrupted files in %s:\n  %s", len(problems), dir, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// verifyOutputs runs the fast check when reusing a directory. Directories
+// produced before manifests existed get one written on first use.
+func verifyOutputs(dir string) error {
+	err := VerifyManifest(dir, false)
+	if errors.Is(err, ErrNoManifest) {
+		_, err = WriteManifest(dir)
+	}
+	return err
+}
+
+func fileDigest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyResult is the outcome of verifying one output directory
+type VerifyResult struct {
+	Lib *Lib
+	Dir string
+	Err error
+}
+
+// Verify runs a full digest check of every build and prebuilt directory
+// of libs.
+func Verify(config Config, libs []*Lib) []VerifyResult {
+	var results []VerifyResult
+	for _, lib := range libs {
+		dirs, err := listTargetDirs(config, lib)
+		if err != nil {
+			results = append(results, VerifyResult{Lib: lib, Err: err})
+			continue
+		}
+		for _, dir := range dirs {
+			results = append(results, VerifyResult{
+				Lib: lib,
+				Dir: dir,
+				Err: VerifyManifest(dir, true),
+			})
+		}
+	}
+	return results
+}
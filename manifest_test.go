@@ -0,0 +1,67 @@
+package clibs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lib := filepath.Join(dir, "lib", "libgc.a")
+	if err := os.WriteFile(lib, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveHash(dir, buildInputs(LibSpec{Name: "bdwgc"}, ProfileRelease)); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := WriteManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Path != "lib/libgc.a" {
+		t.Fatalf("unexpected manifest files: %+v", manifest.Files)
+	}
+	if err := VerifyManifest(dir, true); err != nil {
+		t.Fatalf("VerifyManifest() on intact dir: %v", err)
+	}
+
+	// Same size, different content: only the full check notices
+	if err := os.WriteFile(lib, []byte("ARCHIVE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(dir, false); err != nil {
+		t.Errorf("fast VerifyManifest() = %v, want nil", err)
+	}
+	if err := VerifyManifest(dir, true); err == nil {
+		t.Errorf("full VerifyManifest() = nil, want sha256 mismatch")
+	}
+
+	if err := os.Remove(lib); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyOutputs(dir); err == nil {
+		t.Errorf("verifyOutputs() = nil after removing a file")
+	}
+}
+
+func TestVerifyOutputsWritesMissingManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "libz.a"), []byte("z"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyManifest(dir, false); !errors.Is(err, ErrNoManifest) {
+		t.Fatalf("VerifyManifest() = %v, want ErrNoManifest", err)
+	}
+	if err := verifyOutputs(dir); err != nil {
+		t.Fatalf("verifyOutputs() = %v", err)
+	}
+	if _, err := ReadManifest(dir); err != nil {
+		t.Errorf("manifest not written: %v", err)
+	}
+}
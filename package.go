@@ -0,0 +1,291 @@
+package clibs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SumsFile lists the sha256 of the archives in a release dir, in the
+// format of sha256sum
+const SumsFile = "SHA256SUMS"
+
+// SumExt is appended to the archive name for the file holding its own
+// SumsFile line. Unlike the SumsFile, it is written once per archive, so
+// concurrent publishes of a release cannot lose it.
+const SumExt = ".sha256"
+
+// prebuiltTag returns the release tag of prebuilt archives of spec
+func prebuiltTag(spec LibSpec) string {
+	return fmt.Sprintf("%s/%s", spec.Name, spec.Version)
+}
+
+// prebuiltArchiveName returns the file name of the prebuilt archive of spec
+// for targetTriple
+func prebuiltArchiveName(spec LibSpec, targetTriple string) string {
+	return fmt.Sprintf("%s-%s-%s.tar.gz", spec.Name, spec.Version, targetTriple)
+}
+
+// PackageResult describes one prebuilt archive written by Package
+type PackageResult struct {
+	Lib     *Lib
+	Target  string
+	Archive string
+	Sha256  string
+}
+
+// Package builds libs from source for the target in config, reusing
+// existing builds, and writes their prebuilt archives with a SumsFile to
+// outDir. Archives are signed if config has a SigningKey. Only release
+// builds are packaged.
+func Package(ctx context.Context, config Config, libs []*Lib, outDir string) ([]PackageResult, error) {
+	if config.Goos == "" {
+		config.Goos = runtime.GOOS
+	}
+	if config.Goarch == "" {
+		config.Goarch = runtime.GOARCH
+	}
+	config.Profile = config.Profile.normalize()
+	config.Logger = config.logger()
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	if config.Profile != ProfileRelease {
+		return nil, fmt.Errorf("prebuilt archives only exist for release builds, not %s", config.Profile)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var results []PackageResult
+	for _, lib := range libs {
+		log := config.libLogger(lib)
+		// Never package a downloaded prebuilt lib
+		buildDir, err := lib.tryBuildLib(ctx, config, BuildDirName)
+		if err != nil {
+			return results, newError(lib, targetTriple, PhaseBuild, err)
+		}
+		archive := filepath.Join(outDir, prebuiltArchiveName(lib.Config, targetTriple))
+		sum, err := writeArchive(buildDir, targetTriple, archive)
+		if err != nil {
+			return results, newError(lib, targetTriple, PhasePackage, err)
+		}
+		if config.SigningKey != nil {
+			if err := signArchive(config.SigningKey, archive, sum); err != nil {
+				return results, newError(lib, targetTriple, PhasePackage, err)
+			}
+		}
+		log.infof("packaged %s", archive)
+		results = append(results, PackageResult{Lib: lib, Target: targetTriple, Archive: archive, Sha256: sum})
+	}
+
+	sums := make(map[string]string)
+	for _, result := range results {
+		sums[filepath.Base(result.Archive)] = result.Sha256
+	}
+	if err := updateSums(filepath.Join(outDir, SumsFile), sums); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// writeArchive writes dir as a deterministic tar.gz with entries under
+// prefix and returns its sha256. Entries are sorted, and times, owners and
+// permissions are normalized, so identical dirs give identical archives.
+func writeArchive(dir, prefix, archive string) (string, error) {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	if err := verifyOutputs(dir); err != nil {
+		return "", err
+	}
+
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	tmp := archive + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	h := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, h))
+	tw := tar.NewWriter(gz)
+	if err := writeArchiveEntries(tw, dir, prefix, paths); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, archive); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeArchiveEntries(tw *tar.Writer, dir, prefix string, paths []string) error {
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix
+		if rel != "." {
+			name += "/" + filepath.ToSlash(rel)
+		}
+		hdr := &tar.Header{Name: name, ModTime: time.Unix(0, 0), Format: tar.FormatPAX}
+		var content []byte
+		switch {
+		case fi.IsDir():
+			hdr.Typeflag, hdr.Name, hdr.Mode = tar.TypeDir, name+"/", 0755
+		case fi.Mode()&os.ModeSymlink != 0:
+			if hdr.Linkname, err = os.Readlink(path); err != nil {
+				return err
+			}
+			hdr.Typeflag, hdr.Mode = tar.TypeSymlink, 0777
+		case rel == BuildHashFile:
+			// The state records when and where the build ran
+			if content, err = normalizedBuildState(dir); err != nil {
+				return err
+			}
+			hdr.Typeflag, hdr.Size, hdr.Mode = tar.TypeReg, int64(len(content)), 0644
+		case fi.Mode().IsRegular():
+			hdr.Typeflag, hdr.Size, hdr.Mode = tar.TypeReg, fi.Size(), 0644
+			if fi.Mode()&0111 != 0 {
+				hdr.Mode = 0755
+			}
+		default:
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if content != nil {
+			if _, err := tw.Write(content); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveTopDir returns the top dir of the first entry of a tar.gz, the
+// target triple for archives written by writeArchive
+func archiveTopDir(archive string) (string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil {
+		return "", err
+	}
+	top, _, _ := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+	return top, nil
+}
+
+// readSums parses a SumsFile into file name and sha256 pairs
+func readSums(r io.Reader) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("malformed %s line: %q", SumsFile, line)
+		}
+		// sha256sum marks binary mode with "*"
+		sums[strings.TrimPrefix(strings.TrimSpace(name), "*")] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// formatSums encodes sums in the format of sha256sum, sorted by name
+func formatSums(sums map[string]string) []byte {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+	return b.Bytes()
+}
+
+// updateSums merges sums into the SumsFile at path, keeping the entries of
+// other archives
+func updateSums(path string, sums map[string]string) error {
+	merged := make(map[string]string)
+	if f, err := os.Open(path); err == nil {
+		existing, err := readSums(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		merged = existing
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for name, sum := range sums {
+		merged[name] = sum
+	}
+	return os.WriteFile(path, formatSums(merged), 0644)
+}
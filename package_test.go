@@ -0,0 +1,154 @@
+package clibs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackageDeterministic(t *testing.T) {
+	lib := &Lib{
+		ModName: "example.com/zlib",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:    "zlib",
+			Version: "1.3",
+			Build: &BuildSpec{
+				Command: `mkdir -p "$CLIBS_BUILD_DIR/lib" && echo lib > "$CLIBS_BUILD_DIR/lib/libz.a"`,
+			},
+		},
+	}
+	config := Config{Goos: "linux", Goarch: "amd64", Logger: Discard}
+	outDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outDir, SumsFile), []byte("abc  other.tar.gz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Package(context.Background(), config, []*Lib{lib}, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || filepath.Base(results[0].Archive) != "zlib-1.3-x86_64-unknown-linux.tar.gz" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	first, err := os.ReadFile(results[0].Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Touch the outputs; the archive must not change
+	buildDir := filepath.Join(lib.Path, BuildDirName, "x86_64-unknown-linux")
+	if err := os.Chmod(filepath.Join(buildDir, "lib", "libz.a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	results, err = Package(context.Background(), config, []*Lib{lib}, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile(results[0].Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("archives differ between runs")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := []string{
+		"x86_64-unknown-linux/",
+		"x86_64-unknown-linux/" + BuildHashFile,
+		"x86_64-unknown-linux/" + ManifestFile,
+		"x86_64-unknown-linux/lib/",
+		"x86_64-unknown-linux/lib/libz.a",
+	}
+	if strings.Join(names, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected entries:\n%s", strings.Join(names, "\n"))
+	}
+
+	sums, err := os.ReadFile(filepath.Join(outDir, SumsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSums := "abc  other.tar.gz\n" + results[0].Sha256 + "  zlib-1.3-x86_64-unknown-linux.tar.gz\n"
+	if string(sums) != wantSums {
+		t.Fatalf("unexpected %s:\n%s", SumsFile, sums)
+	}
+}
+
+func TestPackageSeparateBuilds(t *testing.T) {
+	lib := &Lib{
+		ModName: "example.com/zlib",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:    "zlib",
+			Version: "1.3",
+			Build: &BuildSpec{
+				Command: `mkdir -p "$CLIBS_BUILD_DIR/lib" && echo lib > "$CLIBS_BUILD_DIR/lib/libz.a"`,
+			},
+		},
+	}
+	// Force rebuilds, so each archive comes from its own build
+	config := Config{Goos: "linux", Goarch: "amd64", Force: true, Logger: Discard}
+	var sums []string
+	for i := 0; i < 2; i++ {
+		results, err := Package(context.Background(), config, []*Lib{lib}, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, results[0].Sha256)
+
+		hostname, _ := os.Hostname()
+		content, err := os.ReadFile(results[0].Archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Base(hdr.Name) != BuildHashFile {
+				continue
+			}
+			state, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hostname != "" && strings.Contains(string(state), hostname) {
+				t.Fatalf("archived build state leaks the hostname:\n%s", state)
+			}
+		}
+	}
+	if sums[0] != sums[1] {
+		t.Fatalf("archives of separate builds differ: %s != %s", sums[0], sums[1])
+	}
+}
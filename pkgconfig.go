@@ -0,0 +1,131 @@
+package clibs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pkgConfigDirs are the dirs under a build dir searched by pkg-config
+var pkgConfigDirs = []string{"lib/pkgconfig", "share/pkgconfig"}
+
+// pkgConfigName returns the name of the .pc file of the spec
+func (c *LibSpec) pkgConfigName() string {
+	if c.PkgConfig.Name != "" {
+		return c.PkgConfig.Name
+	}
+	return c.Name
+}
+
+// pkgConfigFlags returns the Cflags and Libs of the .pc file of the spec,
+// in terms of the ${includedir} and ${libdir} variables
+func (c *LibSpec) pkgConfigFlags() (cflags, libs string) {
+	cflags, libs = c.PkgConfig.Cflags, c.PkgConfig.Libs
+	if cflags == "" {
+		cflags = "-I${includedir}"
+	}
+	if libs == "" {
+		libs = "-L${libdir} -l" + c.Name
+	}
+	return cflags, libs
+}
+
+// writePkgConfig generates the .pc file of lib in buildDir unless the
+// build installed one. The prefix is relative to the .pc file, so prebuilt
+// archives and store links can be moved.
+func (lib *Lib) writePkgConfig(buildDir string) error {
+	spec := &lib.Config
+	if spec.PkgConfig == nil {
+		return nil
+	}
+	name := spec.pkgConfigName()
+	path := filepath.Join(buildDir, "lib", "pkgconfig", name+".pc")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	cflags, libs := spec.pkgConfigFlags()
+	description := spec.PkgConfig.Description
+	if description == "" {
+		description = spec.Name + " built by clibs"
+	}
+
+	var b strings.Builder
+	b.WriteString("prefix=${pcfiledir}/../..\n")
+	b.WriteString("exec_prefix=${prefix}\n")
+	b.WriteString("libdir=${exec_prefix}/lib\n")
+	b.WriteString("includedir=${prefix}/include\n\n")
+	fmt.Fprintf(&b, "Name: %s\n", name)
+	fmt.Fprintf(&b, "Description: %s\n", description)
+	fmt.Fprintf(&b, "Version: %s\n", strings.TrimPrefix(spec.Version, "v"))
+	if len(spec.PkgConfig.Requires) > 0 {
+		fmt.Fprintf(&b, "Requires: %s\n", strings.Join(spec.PkgConfig.Requires, ", "))
+	}
+	fmt.Fprintf(&b, "Libs: %s\n", libs)
+	fmt.Fprintf(&b, "Cflags: %s\n", cflags)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// pkgConfigPath returns the pkg-config dirs present in buildDir
+func pkgConfigPath(buildDir string) []string {
+	var dirs []string
+	for _, dir := range pkgConfigDirs {
+		dir = filepath.Join(buildDir, filepath.FromSlash(dir))
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// pkgConfigPathVar returns the PKG_CONFIG_PATH of libs for the target of
+// config: the pkg-config dirs of their builds followed by the current
+// $PKG_CONFIG_PATH, and the libs providing dirs. Libs not built for the
+// target are skipped and Value is empty if no lib provides any dir.
+func pkgConfigPathVar(config Config, libs []*Lib) (ExportVar, error) {
+	config = config.buildDefaults()
+	v := ExportVar{Key: "PKG_CONFIG_PATH"}
+	var dirs []string
+	for _, lib := range libs {
+		if err := lib.resolveEnv(config); errors.Is(err, ErrNotBuilt) {
+			continue
+		} else if err != nil {
+			return v, newError(lib, getTargetTriple(config.Goos, config.Goarch), PhaseExport, err)
+		}
+		if libDirs := pkgConfigPath(envValue(lib.Env, EnvBuildDir)); len(libDirs) > 0 {
+			dirs = append(dirs, libDirs...)
+			v.Libs = append(v.Libs, lib.ModName)
+		}
+	}
+	if len(dirs) == 0 {
+		return v, nil
+	}
+	if existing := os.Getenv("PKG_CONFIG_PATH"); existing != "" {
+		dirs = append(dirs, existing)
+	}
+	v.Value = strings.Join(dirs, string(os.PathListSeparator))
+	return v, nil
+}
+
+// validatePkgConfig checks the pkgconfig section of the spec
+func (c *LibSpec) validatePkgConfig() error {
+	if c.PkgConfig == nil {
+		return nil
+	}
+	name := c.pkgConfigName()
+	if name == "" || strings.ContainsAny(name, "/\\ ") {
+		return fmt.Errorf("pkgconfig: invalid name %q", name)
+	}
+	for _, req := range c.PkgConfig.Requires {
+		if strings.TrimSpace(req) == "" {
+			return fmt.Errorf("pkgconfig: empty requires entry")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package clibs
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPkgConfig(t *testing.T) {
+	config := Config{Goos: "linux", Goarch: "amd64", Logger: Discard}
+	base := &Lib{
+		ModName: "example.com/base",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:      "base",
+			Version:   "v1.2.0",
+			PkgConfig: &PkgConfigSpec{},
+		},
+	}
+	top := &Lib{
+		ModName: "example.com/top",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:    "top",
+			Version: "2.0",
+			PkgConfig: &PkgConfigSpec{
+				Libs:     "-L${libdir} -ltop -lm",
+				Cflags:   "-I${includedir}/top -DTOP",
+				Requires: []string{"base"},
+			},
+		},
+	}
+	// Upstream installs its own .pc file, which is kept
+	installed := &Lib{
+		ModName: "example.com/installed",
+		Path:    t.TempDir(),
+		Config: LibSpec{
+			Name:      "installed",
+			Version:   "1.0",
+			Build:     &BuildSpec{Command: `mkdir -p "$CLIBS_BUILD_DIR/lib/pkgconfig" && echo upstream > "$CLIBS_BUILD_DIR/lib/pkgconfig/installed.pc"`},
+			PkgConfig: &PkgConfigSpec{},
+		},
+	}
+	libs := []*Lib{base, top, installed}
+	if err := Build(config, libs); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := os.ReadFile(filepath.Join(base.Path, BuildDirName, "x86_64-unknown-linux", "lib", "pkgconfig", "base.pc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"prefix=${pcfiledir}/../..", "Version: 1.2.0", "Libs: -L${libdir} -lbase", "Cflags: -I${includedir}"} {
+		if !strings.Contains(string(pc), line+"\n") {
+			t.Errorf("base.pc has no %q:\n%s", line, pc)
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(installed.Path, BuildDirName, "x86_64-unknown-linux", "lib", "pkgconfig", "installed.pc"))
+	if err != nil || string(content) != "upstream\n" {
+		t.Fatalf("installed .pc file replaced: %q, %v", content, err)
+	}
+
+	// One PKG_CONFIG_PATH for all libs, followed by the existing one
+	extra := filepath.Join(t.TempDir(), "pkgconfig")
+	t.Setenv("PKG_CONFIG_PATH", extra)
+	exports, err := ExportContext(context.Background(), config, libs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range exports {
+		if strings.HasPrefix(line, "PKG_CONFIG_PATH=") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 1 {
+		t.Fatalf("got %d PKG_CONFIG_PATH lines, want 1: %q", len(lines), lines)
+	}
+
+	vars, err := ExportVars(context.Background(), config, libs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkgConfigPath string
+	for _, v := range vars {
+		if v.Key == "PKG_CONFIG_PATH" {
+			pkgConfigPath = v.Value
+		}
+	}
+	if "PKG_CONFIG_PATH="+pkgConfigPath != lines[0] {
+		t.Fatalf("ExportVars and ExportContext disagree: %s, %s", pkgConfigPath, lines[0])
+	}
+	dirs := filepath.SplitList(pkgConfigPath)
+	if len(dirs) != 4 || dirs[3] != extra {
+		t.Fatalf("PKG_CONFIG_PATH is not the 3 lib dirs and %s: %s", extra, pkgConfigPath)
+	}
+
+	if _, err := exec.LookPath("pkg-config"); err != nil {
+		t.Skip("pkg-config not found")
+	}
+	cmd := exec.Command("pkg-config", "--cflags", "--libs", "top")
+	cmd.Env = append(os.Environ(), "PKG_CONFIG_PATH="+pkgConfigPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("pkg-config failed: %v\n%s", err, output)
+	}
+	// The prefix is relative to the .pc file
+	topPC := filepath.Join(top.Path, BuildDirName, "x86_64-unknown-linux", "lib", "pkgconfig")
+	basePC := filepath.Join(base.Path, BuildDirName, "x86_64-unknown-linux", "lib", "pkgconfig")
+	for _, flag := range []string{"-I" + topPC + "/../../include/top", "-DTOP", "-I" + basePC + "/../../include", "-ltop", "-lbase", "-lm"} {
+		if !strings.Contains(string(output), flag+" ") {
+			t.Errorf("pkg-config output has no %s: %s", flag, output)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package clibs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Action is what Build would do for a lib and target
+type Action string
+
+const (
+	ActionUsePrebuilt      Action = "use-prebuilt"
+	ActionDownloadPrebuilt Action = "download-prebuilt"
+	ActionReuseBuild       Action = "reuse-build"
+	ActionLinkStore        Action = "link-store"
+	ActionBuild            Action = "build"
+	ActionFetchAndBuild    Action = "fetch-and-build"
+)
+
+// PlanItem explains the decision for one lib and target
+type PlanItem struct {
+	Lib    string `json:"lib"`
+	Target string `json:"target"`
+	Action Action `json:"action"`
+	Dir    string `json:"dir"`
+	Reason string `json:"reason"`
+	// Diff lists the input fields that changed since Dir was produced
+	Diff []string `json:"diff,omitempty"`
+	// Fallback is the plan if downloading a prebuilt archive fails
+	Fallback *PlanItem `json:"fallback,omitempty"`
+}
+
+// Plan reports what Build would do for every lib without fetching,
+// building or writing anything.
+func Plan(config Config, libs []*Lib) ([]PlanItem, error) {
+	return PlanContext(context.Background(), config, libs)
+}
+
+// PlanContext is like Plan, cancelling the compiler probe when ctx is
+// done. Only `--version` of the C compilers is run, to find the store
+// builds of remote libs as Build would.
+func PlanContext(ctx context.Context, config Config, libs []*Lib) ([]PlanItem, error) {
+	if config.Goos == "" {
+		config.Goos = runtime.GOOS
+	}
+	if config.Goarch == "" {
+		config.Goarch = runtime.GOARCH
+	}
+	config.Profile = config.Profile.normalize()
+
+	var items []PlanItem
+	for _, lib := range libs {
+		item, err := lib.plan(ctx, config)
+		if err != nil {
+			return nil, newError(lib, getTargetTriple(config.Goos, config.Goarch), PhaseBuild, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// plan mirrors the decisions of checkOrBuild
+func (lib *Lib) plan(ctx context.Context, config Config) (PlanItem, error) {
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	targetDirName := getTargetDirName(targetTriple, config.Profile)
+	inputs := buildInputs(lib.Config, config.Profile)
+
+	skipPrebuilt := lib.prebuiltSkipReason(config)
+	require := config.PrebuiltPolicy == PrebuiltRequire && lib.Sum != ""
+	if skipPrebuilt != "" && require {
+		return PlanItem{}, fmt.Errorf("prebuilt lib required: %s", skipPrebuilt)
+	}
+
+	var prebuiltReason string
+	var prebuiltDiff []string
+	if skipPrebuilt == "" {
+		prebuiltDir, err := getBuildDirByName(config, lib, PrebuiltDirName, targetDirName)
+		if err != nil {
+			return PlanItem{}, err
+		}
+		if !config.Prebuilt {
+			status := inspectDir(prebuiltDir, inputs)
+			if status.OK {
+				if err := config.checkVerification(prebuiltDir); err != nil {
+					status.OK, status.Reason = false, err.Error()
+				}
+			}
+			if status.OK {
+				return PlanItem{
+					Lib:    lib.ModName,
+					Target: targetTriple,
+					Action: ActionUsePrebuilt,
+					Dir:    prebuiltDir,
+					Reason: status.Reason,
+				}, nil
+			}
+			prebuiltReason = "prebuilt cache: " + status.Reason
+			prebuiltDiff = status.Diff
+		}
+	}
+
+	dirName := BuildDirName
+	if config.Prebuilt {
+		dirName = PrebuiltDirName
+	}
+	buildItem, err := lib.planBuild(ctx, config, dirName, targetTriple, targetDirName, inputs)
+	if err != nil {
+		return PlanItem{}, err
+	}
+	if skipPrebuilt == "" {
+		base, err := config.prebuiltBaseURL()
+		if err != nil {
+			return PlanItem{}, err
+		}
+		url := prebuiltURL(base, lib.Config, prebuiltArchiveName(lib.Config, targetTriple))
+		if age, ok := lib.recentlyMissing(config, url); ok {
+			skipPrebuilt = fmt.Sprintf("prebuilt lib was not found %s ago", age.Round(time.Second))
+		}
+	}
+	if skipPrebuilt != "" {
+		if buildItem.Action != ActionReuseBuild && buildItem.Action != ActionLinkStore && !config.Force {
+			buildItem.Reason = skipPrebuilt + "; " + buildItem.Reason
+		}
+		return buildItem, nil
+	}
+
+	prebuiltDir, err := getPrebuiltDir(config, lib)
+	if err != nil {
+		return PlanItem{}, err
+	}
+	reason := "would try to download a prebuilt lib, falling back to " + string(buildItem.Action)
+	fallback := &buildItem
+	if require {
+		reason = "would download a prebuilt lib, failing if none is available"
+		fallback = nil
+	}
+	if prebuiltReason != "" {
+		reason = prebuiltReason + "; " + reason
+	}
+	return PlanItem{
+		Lib:      lib.ModName,
+		Target:   targetTriple,
+		Action:   ActionDownloadPrebuilt,
+		Dir:      prebuiltDir,
+		Reason:   reason,
+		Diff:     prebuiltDiff,
+		Fallback: fallback,
+	}, nil
+}
+
+// planBuild mirrors the decisions of tryBuildLib
+func (lib *Lib) planBuild(ctx context.Context, config Config, dirName, targetTriple, targetDirName string, inputs StateInputs) (PlanItem, error) {
+	buildDir, err := getBuildDirByName(config, lib, dirName, targetDirName)
+	if err != nil {
+		return PlanItem{}, err
+	}
+	item := PlanItem{Lib: lib.ModName, Target: targetTriple, Dir: buildDir}
+
+	if config.Force {
+		item.Reason = "forced rebuild"
+	} else {
+		status := inspectDir(buildDir, inputs)
+		if status.OK && !config.hasCompileCommands(buildDir) {
+			status = dirStatus{Reason: "no " + CompileCommandsFile + " recorded"}
+		}
+		if status.OK {
+			item.Action = ActionReuseBuild
+			item.Reason = status.Reason
+			return item, nil
+		}
+		item.Reason = status.Reason
+		item.Diff = status.Diff
+
+		// Mirrors tryStoreBuild
+		if lib.Sum != "" && dirName == BuildDirName {
+			storeDir, err := getStoreDir(ctx, config, lib)
+			if err != nil {
+				return PlanItem{}, err
+			}
+			if inspectDir(storeDir, inputs).OK && config.hasCompileCommands(storeDir) {
+				item.Action = ActionLinkStore
+				item.Reason += "; identical build in " + storeDir
+				return item, nil
+			}
+		}
+	}
+
+	downloadDir, err := getDownloadDir(config, lib)
+	if err != nil {
+		return PlanItem{}, err
+	}
+	status := inspectDir(downloadDir, downloadInputs(lib.Config))
+	if status.OK {
+		item.Action = ActionBuild
+		return item, nil
+	}
+	item.Action = ActionFetchAndBuild
+	item.Reason += "; download: " + status.Reason
+	item.Diff = append(item.Diff, status.Diff...)
+	return item, nil
+}
+
+// dirStatus is the result of inspecting a download or build directory
+type dirStatus struct {
+	OK     bool
+	Reason string
+	Diff   []string
+	State  *BuildState
+}
+
+// inspectDir checks dir against inputs like checkHash and verifyOutputs
+// do, but never writes to dir.
+func inspectDir(dir string, inputs StateInputs) dirStatus {
+	if _, err := os.Stat(dir); err != nil {
+		return dirStatus{Reason: fmt.Sprintf("missing %s", dir)}
+	}
+	state, err := ReadBuildState(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dirStatus{Reason: fmt.Sprintf("no build state in %s", dir)}
+		}
+		return dirStatus{Reason: err.Error()}
+	}
+	expected, err := inputs.Digest()
+	if err != nil {
+		return dirStatus{Reason: err.Error(), State: state}
+	}
+	if state.Digest != expected {
+		return dirStatus{
+			Reason: "inputs changed",
+			Diff:   diffInputs(state.Inputs, inputs),
+			State:  state,
+		}
+	}
+	if err := VerifyManifest(dir, false); err != nil && !errors.Is(err, ErrNoManifest) {
+		return dirStatus{Reason: fmt.Sprintf("corrupted outputs: %v", err), State: state}
+	}
+	return dirStatus{OK: true, Reason: "build state matches", State: state}
+}
+
+// diffInputs returns the field-level differences between two inputs
+func diffInputs(old, new StateInputs) []string {
+	oldFields, newFields := flattenInputs(old), flattenInputs(new)
+	var diff []string
+	for k, v := range newFields {
+		if o, ok := oldFields[k]; !ok {
+			diff = append(diff, fmt.Sprintf("+ %s: %s", k, shorten(v)))
+		} else if o != v {
+			diff = append(diff, fmt.Sprintf("~ %s: %s -> %s", k, shorten(o), shorten(v)))
+		}
+	}
+	for k, o := range oldFields {
+		if _, ok := newFields[k]; !ok {
+			diff = append(diff, fmt.Sprintf("- %s: %s", k, shorten(o)))
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i][2:] < diff[j][2:]
+	})
+	return diff
+}
+
+// flattenInputs maps dotted field paths to JSON encoded leaf values
+func flattenInputs(inputs StateInputs) map[string]string {
+	fields := make(map[string]string)
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return fields
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fields
+	}
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				walk(strings.TrimPrefix(prefix+"."+k, "."), e)
+			}
+		case []any:
+			for i, e := range v {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), e)
+			}
+		case nil:
+		default:
+			b, _ := json.Marshal(v)
+			fields[prefix] = string(b)
+		}
+	}
+	walk("", normalizeValue(v))
+	return fields
+}
+
+// shorten keeps long values such as build scripts readable in diffs
+func shorten(s string) string {
+	const max = 80
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
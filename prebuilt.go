@@ -0,0 +1,350 @@
+package clibs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ProjectSumFile pins the sha256 of prebuilt archives for a project, in
+// the format of SumsFile. It lives next to the go.mod of the project.
+const ProjectSumFile = "clibs.sum"
+
+// PrebuiltPolicy selects whether versioned modules use prebuilt archives
+type PrebuiltPolicy string
+
+const (
+	// PrebuiltPrefer uses a prebuilt archive if one is available and
+	// falls back to building from source
+	PrebuiltPrefer PrebuiltPolicy = "prefer"
+	// PrebuiltNever always builds from source
+	PrebuiltNever PrebuiltPolicy = "never"
+	// PrebuiltRequire fails if no valid prebuilt archive is available.
+	// Local modules, which have no releases, are still built from source.
+	PrebuiltRequire PrebuiltPolicy = "require"
+)
+
+// ParsePrebuiltPolicy parses a policy name, the empty string means prefer
+func ParsePrebuiltPolicy(name string) (PrebuiltPolicy, error) {
+	switch p := PrebuiltPolicy(strings.ToLower(name)); p {
+	case "":
+		return PrebuiltPrefer, nil
+	case PrebuiltPrefer, PrebuiltNever, PrebuiltRequire:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown prebuilt policy %q (expected never, prefer or require)", name)
+}
+
+// prebuiltMissTTL is how long a prebuilt archive that was not found is not
+// requested again
+var prebuiltMissTTL = time.Hour
+
+// prebuiltSkipReason returns why no prebuilt lib is used for lib, or "" if
+// one is looked up
+func (lib *Lib) prebuiltSkipReason(config Config) string {
+	switch {
+	case config.PrebuiltPolicy == PrebuiltNever:
+		return "prebuilt policy is never"
+	case lib.Sum == "":
+		return "local module, prebuilt libs are not used"
+	case config.Profile.normalize() != ProfileRelease:
+		return fmt.Sprintf("prebuilt libs only exist for release builds, not %s", config.Profile)
+	case config.Force:
+		return "forced rebuild"
+	case config.CompileCommands:
+		return "recording compile commands"
+	}
+	return ""
+}
+
+// missingMarker returns the file recording that the prebuilt archive of
+// lib was not found
+func (lib *Lib) missingMarker(config Config) (string, error) {
+	prebuiltRootDir, err := getPrebuiltDir(config, lib)
+	if err != nil {
+		return "", err
+	}
+	archiveName := prebuiltArchiveName(lib.Config, getTargetTriple(config.Goos, config.Goarch))
+	return filepath.Join(prebuiltRootDir, ".missing-"+archiveName), nil
+}
+
+// recentlyMissing reports how long ago url was not found, if that was less
+// than prebuiltMissTTL ago. A required archive is always requested again,
+// failing the build on a stale 404 would need a clean to recover.
+func (lib *Lib) recentlyMissing(config Config, url string) (time.Duration, bool) {
+	if config.PrebuiltPolicy == PrebuiltRequire {
+		return 0, false
+	}
+	marker, err := lib.missingMarker(config)
+	if err != nil {
+		return 0, false
+	}
+	info, err := os.Stat(marker)
+	if err != nil {
+		return 0, false
+	}
+	content, err := os.ReadFile(marker)
+	if err != nil || strings.TrimSpace(string(content)) != url {
+		return 0, false
+	}
+	age := time.Since(info.ModTime())
+	return age, age < prebuiltMissTTL
+}
+
+// tryDownloadPrebuilt downloads, verifies and extracts the prebuilt archive
+// of lib. The archive is only moved into the prebuilt dir after its sha256
+// and embedded build state have been checked.
+func (lib *Lib) tryDownloadPrebuilt(ctx context.Context, config Config) (string, error) {
+	log := config.libLogger(lib)
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+	prebuiltRootDir, err := getPrebuiltDir(config, lib)
+	if err != nil {
+		return "", err
+	}
+	prebuiltTargetDir, err := getBuildDirByName(config, lib, PrebuiltDirName, getTargetDirName(targetTriple, config.Profile))
+	if err != nil {
+		return "", err
+	}
+	base, err := config.prebuiltBaseURL()
+	if err != nil {
+		return "", err
+	}
+	archiveName := prebuiltArchiveName(lib.Config, targetTriple)
+	url := prebuiltURL(base, lib.Config, archiveName)
+	if age, ok := lib.recentlyMissing(config, url); ok {
+		log.debugf("Prebuilt lib %s was not found %s ago", url, age.Round(time.Second))
+		return "", newError(lib, targetTriple, PhasePrebuilt, fmt.Errorf("%s not found %s ago", url, age.Round(time.Second)))
+	}
+
+	if err := os.MkdirAll(prebuiltRootDir, 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp(prebuiltRootDir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	log.debugf("Downloading prebuilt lib %s to %s", url, tmpDir)
+	stepCtx, cancel := config.stepContext(ctx)
+	defer cancel()
+	archive := filepath.Join(tmpDir, archiveName)
+	if err := downloadFile(stepCtx, url, archive, config.downloadAuth()); err != nil {
+		log.debugf("No prebuilt lib available: %v", err)
+		if isNotFound(err) {
+			if marker, merr := lib.missingMarker(config); merr == nil {
+				os.WriteFile(marker, []byte(url+"\n"), 0644)
+			}
+		}
+		return "", newError(lib, targetTriple, PhasePrebuilt, err)
+	}
+
+	reject := func(err error) (string, error) {
+		log.warnf("Rejected prebuilt lib %s: %v", url, err)
+		return "", newError(lib, targetTriple, PhasePrebuilt, err)
+	}
+	sum, err := lib.verifyArchiveSum(stepCtx, config, base, archive)
+	if err != nil {
+		return reject(err)
+	}
+	verification, err := lib.verifyArchiveSignature(stepCtx, config, base, archiveName, sum)
+	if err != nil {
+		return reject(err)
+	}
+
+	extractDir := filepath.Join(tmpDir, "extract")
+	if err := os.MkdirAll(extractDir, 0755); err != nil {
+		return "", err
+	}
+	cmd := commandContext(stepCtx, "tar", "-xzf", archive, "-C", extractDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return reject(fmt.Errorf("extraction failed: %w - %s", runError(stepCtx, err), output))
+	}
+	extracted := filepath.Join(extractDir, filepath.Base(prebuiltTargetDir))
+	if err := verifyArchiveState(extracted, buildInputs(lib.Config, config.Profile)); err != nil {
+		return reject(err)
+	}
+	if err := VerifyManifest(extracted, true); errors.Is(err, ErrNoManifest) {
+		if _, err := WriteManifest(extracted); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return reject(fmt.Errorf("corrupted outputs: %w", err))
+	}
+
+	if err := writeVerification(extracted, verification); err != nil {
+		return "", err
+	}
+
+	if err := os.RemoveAll(prebuiltTargetDir); err != nil {
+		return "", err
+	}
+	if err := os.Rename(extracted, prebuiltTargetDir); err != nil {
+		return "", fmt.Errorf("failed to move prebuilt lib: %v", err)
+	}
+	log.infof("using downloaded prebuilt lib in %s", prebuiltTargetDir)
+	if lib.Env, err = getBuildEnv(config, lib, prebuiltTargetDir); err != nil {
+		return "", err
+	}
+	return prebuiltTargetDir, nil
+}
+
+// ErrNoChecksum is returned when a required sha256 of an archive is not
+// published
+var ErrNoChecksum = errors.New("no checksum published")
+
+// requireChecksum reports whether archives without a published sha256
+// are refused
+func (c Config) requireChecksum() bool {
+	return c.RequireChecksum || os.Getenv(EnvRequireChecksum) == "1"
+}
+
+// verifyArchiveSum checks the sha256 of archive against its SumExt file,
+// the SumsFile of the release and the ProjectSumFile and returns it. Every
+// source listing the archive must agree and sources that exist but cannot
+// be loaded fail the check. An archive listed nowhere is accepted with a
+// warning, or refused with ErrNoChecksum if checksums are required.
+func (lib *Lib) verifyArchiveSum(ctx context.Context, config Config, base, archive string) (string, error) {
+	log := config.libLogger(lib)
+	name := filepath.Base(archive)
+	_, actual, err := fileDigest(archive)
+	if err != nil {
+		return "", err
+	}
+
+	checked := false
+	for _, sumsURL := range []string{prebuiltURL(base, lib.Config, name+SumExt), prebuiltURL(base, lib.Config, SumsFile)} {
+		// Missing files are fine, failing to load one is not, or anyone
+		// able to break the download would turn the check off
+		sums, err := fetchSums(ctx, sumsURL, config.downloadAuth())
+		if err != nil {
+			return "", fmt.Errorf("failed to load %s: %v", sumsURL, err)
+		}
+		if expected, ok := sums[name]; ok {
+			if expected != actual {
+				return "", fmt.Errorf("sha256 %s does not match %s from %s", actual, expected, sumsURL)
+			}
+			checked = true
+		}
+	}
+
+	if path, ok := config.projectSumFile(); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		sums, err := readSums(f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		if expected, ok := sums[name]; ok {
+			if expected != actual {
+				return "", fmt.Errorf("sha256 %s does not match %s from %s", actual, expected, path)
+			}
+			checked = true
+		}
+	}
+
+	if !checked {
+		if config.requireChecksum() {
+			return "", fmt.Errorf("%w: %s", ErrNoChecksum, name)
+		}
+		log.warnf("no checksum published for %s, only checking its build state", name)
+	}
+	return actual, nil
+}
+
+// verifyArchiveSignature checks the detached signature of the archive
+// against the trusted keys and returns the record of the check. Unsigned
+// archives are refused if signatures are required, signed ones whenever
+// trusted keys are configured.
+func (lib *Lib) verifyArchiveSignature(ctx context.Context, config Config, base, name, sum string) (archiveVerification, error) {
+	log := config.libLogger(lib)
+	v := archiveVerification{Archive: name, Sha256: sum}
+	keys, err := config.trustedKeys()
+	if err != nil {
+		return v, err
+	}
+	sigURL := prebuiltURL(base, lib.Config, name+SignatureExt)
+	sig, err := fetchBytes(ctx, sigURL, config.downloadAuth())
+	if errors.Is(err, errNotFound) {
+		if config.requireSignature() {
+			return v, ErrUnsigned
+		}
+		log.debugf("No signature for %s", name)
+		return v, nil
+	} else if err != nil {
+		return v, err
+	}
+	if len(keys) == 0 {
+		if config.requireSignature() {
+			return v, fmt.Errorf("signature required but no trusted keys configured")
+		}
+		log.debugf("No trusted keys, ignoring signature of %s", name)
+		return v, nil
+	}
+	key, err := verifySignature(keys, name, sum, sig)
+	if err != nil {
+		return v, err
+	}
+	log.debugf("Verified signature of %s", name)
+	v.Signature = strings.TrimSpace(string(sig))
+	v.Key = base64.StdEncoding.EncodeToString(key)
+	return v, nil
+}
+
+// verifyArchiveState checks that the build state embedded in an extracted
+// archive was produced from inputs
+func verifyArchiveState(dir string, inputs StateInputs) error {
+	state, err := ReadBuildState(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("archive has no build state in %s", filepath.Base(dir))
+		}
+		return err
+	}
+	expected, err := inputs.Digest()
+	if err != nil {
+		return err
+	}
+	if state.Digest != expected {
+		diff := diffInputs(state.Inputs, inputs)
+		return fmt.Errorf("archive was built from different inputs: %s", strings.Join(diff, "; "))
+	}
+	return nil
+}
+
+// projectRoot returns the dir of the closest go.mod above config.Dir
+func (c Config) projectRoot() (string, bool) {
+	dir, err := filepath.Abs(c.Dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// projectSumFile returns the ProjectSumFile of the project if it exists
+func (c Config) projectSumFile() (string, bool) {
+	root, ok := c.projectRoot()
+	if !ok {
+		return "", false
+	}
+	path := filepath.Join(root, ProjectSumFile)
+	_, err := os.Stat(path)
+	return path, err == nil
+}
@@ -0,0 +1,185 @@
+package clibs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// publishTestLib packages lib and publishes it to a filesystem store
+func publishTestLib(t *testing.T, lib *Lib, config Config) string {
+	t.Helper()
+	ctx := context.Background()
+	dist := t.TempDir()
+	if _, err := Package(ctx, config, []*Lib{lib}, dist); err != nil {
+		t.Fatal(err)
+	}
+	store := t.TempDir()
+	if _, err := Publish(ctx, config, []*Lib{lib}, dist, store); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func testPrebuiltLib(t *testing.T, version string) *Lib {
+	return &Lib{
+		ModName: "example.com/verified",
+		Path:    t.TempDir(),
+		Sum:     "h1:verified",
+		Config: LibSpec{
+			Name:    "verified",
+			Version: version,
+			Build:   &BuildSpec{Command: `echo lib > "$CLIBS_BUILD_DIR/libverified.a"`},
+		},
+	}
+}
+
+func TestDownloadPrebuiltVerifiesSum(t *testing.T) {
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	lib := testPrebuiltLib(t, "1.0")
+	config.PrebuiltURL = publishTestLib(t, lib, config)
+	config.CacheDir = t.TempDir()
+
+	// Tamper with the published archive
+	archive := filepath.Join(config.PrebuiltURL, "verified", "1.0", prebuiltArchiveName(lib.Config, "x86_64-unknown-linux"))
+	f, err := os.OpenFile(archive, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tampered"))
+	f.Close()
+
+	_, err = lib.tryDownloadPrebuilt(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("tampered archive accepted: %v", err)
+	}
+	prebuiltDir, _ := getPrebuiltDir(config, lib)
+	if entries, _ := os.ReadDir(prebuiltDir); len(entries) != 0 {
+		t.Fatalf("rejected archive left files in %s: %v", prebuiltDir, entries)
+	}
+
+	// Build falls back to the source
+	if err := BuildContext(context.Background(), config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range lib.Env {
+		if strings.HasPrefix(env, EnvBuildDir+"=") && strings.Contains(env, PrebuiltDirName) {
+			t.Fatalf("tampered prebuilt lib used: %s", env)
+		}
+	}
+}
+
+func TestDownloadPrebuiltVerifiesState(t *testing.T) {
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	lib := testPrebuiltLib(t, "1.0")
+	config.PrebuiltURL = publishTestLib(t, lib, config)
+	config.CacheDir = t.TempDir()
+
+	// Same release, different build script
+	lib.Config.Build.Command += " -n"
+	_, err := lib.tryDownloadPrebuilt(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "different inputs") {
+		t.Fatalf("archive of other inputs accepted: %v", err)
+	}
+}
+
+func TestDownloadPrebuiltVerifiesProjectSum(t *testing.T) {
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	lib := testPrebuiltLib(t, "1.0")
+	config.PrebuiltURL = publishTestLib(t, lib, config)
+	config.CacheDir = t.TempDir()
+	os.Remove(filepath.Join(config.PrebuiltURL, "verified", "1.0", SumsFile))
+
+	config.Dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(config.Dir, "go.mod"), []byte("module example.com/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := strings.Repeat("0", 64) + "  " + prebuiltArchiveName(lib.Config, "x86_64-unknown-linux") + "\n"
+	if err := os.WriteFile(filepath.Join(config.Dir, ProjectSumFile), []byte(sum), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := lib.tryDownloadPrebuilt(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), ProjectSumFile) {
+		t.Fatalf("archive not matching %s accepted: %v", ProjectSumFile, err)
+	}
+
+	os.Remove(filepath.Join(config.Dir, ProjectSumFile))
+	if _, err := lib.tryDownloadPrebuilt(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrebuiltPolicy(t *testing.T) {
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	lib := testPrebuiltLib(t, "1.0")
+	store := publishTestLib(t, lib, config)
+
+	usedPrebuilt := func() bool {
+		for _, env := range lib.Env {
+			if strings.HasPrefix(env, EnvBuildDir+"=") {
+				return strings.Contains(env, PrebuiltDirName)
+			}
+		}
+		t.Fatalf("no %s in %v", EnvBuildDir, lib.Env)
+		return false
+	}
+
+	config.CacheDir = t.TempDir()
+	config.PrebuiltURL = store
+	config.PrebuiltPolicy = PrebuiltNever
+	if err := BuildContext(context.Background(), config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+	if usedPrebuilt() {
+		t.Fatal("prebuilt lib used with policy never")
+	}
+
+	// Nothing published under this store
+	config.CacheDir = t.TempDir()
+	config.PrebuiltURL = filepath.Join(t.TempDir(), "store")
+	config.PrebuiltPolicy = PrebuiltRequire
+	err := BuildContext(context.Background(), config, []*Lib{lib})
+	var e *Error
+	if !errors.As(err, &e) || e.Phase != PhasePrebuilt || !strings.Contains(err.Error(), "required") {
+		t.Fatalf("missing prebuilt lib not reported: %v", err)
+	}
+	buildDir, _ := getBuildDirByName(config, lib, BuildDirName, "x86_64-unknown-linux")
+	if _, err := os.Stat(buildDir); err == nil {
+		t.Fatal("built from source with policy require")
+	}
+
+	// Once published, the 404 is still remembered when falling back to
+	// source is allowed, but not when the archive is required
+	if err := os.Rename(store, config.PrebuiltURL); err != nil {
+		t.Fatal(err)
+	}
+	prefer := config
+	prefer.PrebuiltPolicy = PrebuiltPrefer
+	if _, err := lib.tryDownloadPrebuilt(context.Background(), prefer); err == nil || !strings.Contains(err.Error(), "ago") {
+		t.Fatalf("recent 404 requested again: %v", err)
+	}
+	if err := BuildContext(context.Background(), config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+	if !usedPrebuilt() {
+		t.Fatal("prebuilt lib not used with policy require")
+	}
+	// The default profile is release
+	info, err := lib.Info(context.Background(), Config{Goos: "linux", Goarch: "amd64", CacheDir: config.CacheDir, Logger: Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Built || filepath.Base(filepath.Dir(info.BuildDir)) != PrebuiltDirName {
+		t.Fatalf("Info reports %s (built: %v), not the prebuilt dir", info.BuildDir, info.Built)
+	}
+
+	// Force builds from source, which require does not allow
+	config.Force = true
+	err = BuildContext(context.Background(), config, []*Lib{lib})
+	if !errors.As(err, &e) || e.Phase != PhasePrebuilt || !strings.Contains(err.Error(), "forced rebuild") {
+		t.Fatalf("forced rebuild with policy require not reported: %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package clibs
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// waitDelay bounds how long we wait for pipes after killing a command
+const waitDelay = 5 * time.Second
+
+// commandContext is like exec.CommandContext, but cancellation kills the
+// whole process tree of the command instead of only the direct child.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+// runError prefers the context error when a command was cancelled
+func runError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
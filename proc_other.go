@@ -0,0 +1,8 @@
+//go:build !unix
+
+package clibs
+
+import "os/exec"
+
+// setProcessGroup keeps the default behaviour of killing the direct child
+func setProcessGroup(cmd *exec.Cmd) {}
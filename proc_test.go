@@ -0,0 +1,31 @@
+//go:build unix
+
+package clibs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCommandContextKillsProcessTree(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The grandchild keeps stdout open, so Wait only returns early if the
+	// whole process group is killed.
+	cmd := commandContext(ctx, "bash", "-c", "sleep 30 & wait")
+	start := time.Now()
+	_, err := cmd.Output()
+	if elapsed := time.Since(start); elapsed > waitDelay {
+		t.Fatalf("command took %v after cancellation", elapsed)
+	}
+	err = &Error{Lib: "example.com/zlib", Phase: PhaseBuild, Err: runError(ctx, err)}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v does not wrap context.DeadlineExceeded", err)
+	}
+	if got, want := err.Error(), "example.com/zlib: build: context deadline exceeded"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
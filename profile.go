@@ -0,0 +1,65 @@
+package clibs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile selects the compiler flags of a build. Every profile has its own
+// build directory and cache key.
+type Profile string
+
+const (
+	ProfileRelease Profile = "release"
+	ProfileDebug   Profile = "debug"
+	ProfileASan    Profile = "asan"
+	ProfileUBSan   Profile = "ubsan"
+)
+
+type profileFlags struct {
+	cflags  string
+	ldflags string
+}
+
+var profiles = map[Profile]profileFlags{
+	ProfileRelease: {cflags: "-O2"},
+	ProfileDebug:   {cflags: "-O0 -g"},
+	ProfileASan: {
+		cflags:  "-O1 -g -fsanitize=address -fno-omit-frame-pointer",
+		ldflags: "-fsanitize=address",
+	},
+	ProfileUBSan: {
+		cflags:  "-O1 -g -fsanitize=undefined -fno-omit-frame-pointer",
+		ldflags: "-fsanitize=undefined",
+	},
+}
+
+// ParseProfile parses a profile name, the empty string means release
+func ParseProfile(name string) (Profile, error) {
+	p := Profile(strings.ToLower(name))
+	if p == "" {
+		return ProfileRelease, nil
+	}
+	if _, ok := profiles[p]; !ok {
+		return "", fmt.Errorf("unknown build profile %q (expected release, debug, asan or ubsan)", name)
+	}
+	return p, nil
+}
+
+// normalize maps the zero value to ProfileRelease
+func (p Profile) normalize() Profile {
+	if p == "" {
+		return ProfileRelease
+	}
+	return p
+}
+
+// getTargetDirName returns the directory name of a target under _build
+// and _prebuilt. Release builds keep the bare triple.
+func getTargetDirName(targetTriple string, profile Profile) string {
+	profile = profile.normalize()
+	if profile == ProfileRelease {
+		return targetTriple
+	}
+	return targetTriple + "-" + string(profile)
+}
@@ -0,0 +1,317 @@
+package clibs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// prebuiltBaseURL returns the base URL of the prebuilt artifact store.
+// Plain paths are turned into file URLs.
+func (c Config) prebuiltBaseURL() (string, error) {
+	base := c.PrebuiltURL
+	if base == "" {
+		base = os.Getenv(EnvPrebuiltURL)
+	}
+	if base == "" {
+		return ReleaseUrlPrefix, nil
+	}
+	if strings.Contains(base, "://") {
+		return strings.TrimSuffix(base, "/"), nil
+	}
+	abs, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), nil
+}
+
+// prebuiltURL returns the URL of file in the release of spec. GitHub
+// releases use the escaped "<name>/<version>" tag as one path element,
+// other stores use the plain <name>/<version> dirs.
+func prebuiltURL(base string, spec LibSpec, file string) string {
+	if base == ReleaseUrlPrefix {
+		return fmt.Sprintf("%s/%s/%s", base, url.PathEscape(prebuiltTag(spec)), file)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", base, url.PathEscape(spec.Name), url.PathEscape(spec.Version), url.PathEscape(file))
+}
+
+// filePath returns the local path of a file URL
+func filePath(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// Publish uploads the prebuilt archives of libs found in dir, as written
+// by Package, to the artifact store at dest, each with a SumExt file, and
+// updates the SumsFile of each release derived from them. dest is an http(s) URL accepting PUT or a
+// file URL or path. It returns the URLs of the uploaded archives.
+func Publish(ctx context.Context, config Config, libs []*Lib, dir, dest string) ([]string, error) {
+	config.PrebuiltURL = dest
+	base, err := config.prebuiltBaseURL()
+	if err != nil {
+		return nil, err
+	}
+	if base == ReleaseUrlPrefix {
+		return nil, fmt.Errorf("publishing to GitHub releases is not supported, use a release workflow")
+	}
+
+	localSums := make(map[string]string)
+	if f, err := os.Open(filepath.Join(dir, SumsFile)); err == nil {
+		localSums, err = readSums(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var published []string
+	for _, lib := range libs {
+		log := config.libLogger(lib)
+		archives, err := findArchives(dir, lib.Config)
+		if err != nil {
+			return published, newError(lib, "", PhasePublish, err)
+		}
+		if len(archives) == 0 {
+			log.warnf("no prebuilt archives of %s %s in %s", lib.Config.Name, lib.Config.Version, dir)
+			continue
+		}
+
+		sums := make(map[string]string)
+		for _, archive := range archives {
+			name := filepath.Base(archive)
+			sum, ok := localSums[name]
+			if !ok {
+				if _, sum, err = fileDigest(archive); err != nil {
+					return published, err
+				}
+			}
+			sums[name] = sum
+			target := prebuiltURL(base, lib.Config, name)
+			if err := uploadFile(ctx, archive, target); err != nil {
+				return published, newError(lib, "", PhasePublish, err)
+			}
+			if _, err := os.Stat(archive + SignatureExt); err == nil {
+				if err := uploadFile(ctx, archive+SignatureExt, target+SignatureExt); err != nil {
+					return published, newError(lib, "", PhasePublish, err)
+				}
+			}
+			// Written last, an archive is only listed once it is complete
+			if err := uploadBytes(ctx, formatSums(map[string]string{name: sum}), target+SumExt); err != nil {
+				return published, newError(lib, "", PhasePublish, err)
+			}
+			log.infof("published %s", target)
+			published = append(published, target)
+		}
+
+		if err := updateRemoteSums(ctx, base, lib.Config, sums); err != nil {
+			return published, newError(lib, "", PhasePublish, err)
+		}
+	}
+	return published, nil
+}
+
+// findArchives returns the archives of spec in dir, sorted. The triple in
+// the name must be the top dir of the archive, as written by Package, so
+// the archives of version 1.0-rc1 are not taken for those of 1.0.
+func findArchives(dir string, spec LibSpec) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		triple, ok := strings.CutPrefix(entry.Name(), spec.Name+"-"+spec.Version+"-")
+		if !ok {
+			continue
+		}
+		triple, ok = strings.CutSuffix(triple, ".tar.gz")
+		if !ok || triple == "" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		top, err := archiveTopDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if top == triple {
+			archives = append(archives, path)
+		}
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// updateRemoteSums regenerates the SumsFile of the release of spec. It is
+// derived from the SumExt files, which downloads check first: file stores
+// list them all, HTTP stores, which cannot be listed, merge sums into the
+// existing file. A concurrent publish may drop entries of the SumsFile but
+// never of the SumExt files.
+func updateRemoteSums(ctx context.Context, base string, spec LibSpec, sums map[string]string) error {
+	sumsURL := prebuiltURL(base, spec, SumsFile)
+	merged, err := fetchSums(ctx, sumsURL, setPublishAuth)
+	if err != nil {
+		return err
+	}
+	for name, sum := range sums {
+		merged[name] = sum
+	}
+	if dir, ok := filePath(prebuiltURL(base, spec, "")); ok {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+SumExt))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			listed, err := readSums(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			for name, sum := range listed {
+				merged[name] = sum
+			}
+		}
+	}
+	return uploadBytes(ctx, formatSums(merged), sumsURL)
+}
+
+// errNotFound is returned by fetchBytes for missing files
+var errNotFound = errors.New("not found")
+
+// fetchBytes reads a small file from a file or http(s) URL, authorizing
+// http requests with auth if not nil
+func fetchBytes(ctx context.Context, rawURL string, auth func(*http.Request)) ([]byte, error) {
+	if path, ok := filePath(rawURL); ok {
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, errNotFound
+		}
+		return content, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		auth(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", rawURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchSums downloads and parses a SumsFile, returning no sums if it does
+// not exist
+func fetchSums(ctx context.Context, rawURL string, auth func(*http.Request)) (map[string]string, error) {
+	content, err := fetchBytes(ctx, rawURL, auth)
+	if errors.Is(err, errNotFound) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return readSums(bytes.NewReader(content))
+}
+
+func uploadFile(ctx context.Context, path, rawURL string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return uploadBytes(ctx, content, rawURL)
+}
+
+// uploadBytes writes content to a file URL atomically or PUTs it to an
+// http(s) URL
+func uploadBytes(ctx context.Context, content []byte, rawURL string) error {
+	if path, ok := filePath(rawURL); ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// A unique temp file, concurrent publishes may write the same path
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(content); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), path)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, rawURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(content))
+	setPublishAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	}
+	return fmt.Errorf("failed to upload %s: %s", rawURL, resp.Status)
+}
+
+// setPublishAuth adds the bearer token from EnvPublishToken to requests
+func setPublishAuth(req *http.Request) {
+	if token := os.Getenv(EnvPublishToken); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// downloadAuth returns setDownloadAuth if config selects the artifact
+// store, the token of a private store is not sent to the default GitHub
+// releases
+func (c Config) downloadAuth() func(*http.Request) {
+	if c.PrebuiltURL == "" && os.Getenv(EnvPrebuiltURL) == "" {
+		return nil
+	}
+	return setDownloadAuth
+}
+
+// setDownloadAuth adds the bearer token from EnvDownloadToken to requests
+// to the artifact store. It is never sent to the source URLs of libs.
+func setDownloadAuth(req *http.Request) {
+	if token := os.Getenv(EnvDownloadToken); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
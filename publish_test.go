@@ -0,0 +1,227 @@
+package clibs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memStore is a stand-in artifact store accepting PUT and GET
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	// token, if set, is required by GET
+	token string
+	// status fails requests of paths with a status code
+	status map[string]int
+}
+
+func (s *memStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code, ok := s.status[r.URL.Path]; ok {
+		w.WriteHeader(code)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.files[r.URL.Path] = content
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		content, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPublishAndDownload(t *testing.T) {
+	store := &memStore{files: make(map[string][]byte)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	counter := filepath.Join(t.TempDir(), "builds")
+	lib := &Lib{
+		ModName: "example.com/internal",
+		Path:    t.TempDir(),
+		Sum:     "h1:internal",
+		Config: LibSpec{
+			Name:    "internal",
+			Version: "2.0",
+			Build: &BuildSpec{
+				Command: `echo lib > "$CLIBS_BUILD_DIR/libinternal.a"; echo x >> ` + counter,
+			},
+		},
+	}
+	ctx := context.Background()
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	dist := t.TempDir()
+	if _, err := Package(ctx, config, []*Lib{lib}, dist); err != nil {
+		t.Fatal(err)
+	}
+
+	published, err := Publish(ctx, config, []*Lib{lib}, dist, server.URL+"/prebuilt/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || published[0] != server.URL+"/prebuilt/internal/2.0/internal-2.0-x86_64-unknown-linux.tar.gz" {
+		t.Fatalf("unexpected published URLs: %v", published)
+	}
+	sums := string(store.files["/prebuilt/internal/2.0/"+SumsFile])
+	if !strings.HasSuffix(sums, "  internal-2.0-x86_64-unknown-linux.tar.gz\n") {
+		t.Fatalf("unexpected %s: %q", SumsFile, sums)
+	}
+
+	if _, ok := store.files["/prebuilt/internal/2.0/internal-2.0-x86_64-unknown-linux.tar.gz"+SumExt]; !ok {
+		t.Fatalf("no %s file published", SumExt)
+	}
+
+	// A concurrent publish may drop the entry from the SumsFile, the
+	// archive is still verified by its own sum file
+	delete(store.files, "/prebuilt/internal/2.0/"+SumsFile)
+
+	// A fresh cache downloads the archive from the private store instead
+	// of building
+	store.token = "secret"
+	t.Setenv(EnvDownloadToken, "secret")
+	var logs bytes.Buffer
+	config.Logger = NewTextLogger(&logs, LevelWarn)
+	config.CacheDir = t.TempDir()
+	config.PrebuiltURL = server.URL + "/prebuilt"
+	if err := BuildContext(ctx, config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "no checksum published") {
+		t.Fatalf("archive not verified by its sum file:\n%s", logs.String())
+	}
+	wantDir := EnvBuildDir + "=" + filepath.Join(config.CacheDir, "example.com", "internal", "internal", PrebuiltDirName, "x86_64-unknown-linux")
+	found := false
+	for _, env := range lib.Env {
+		found = found || env == wantDir
+	}
+	if !found {
+		t.Fatalf("prebuilt lib not used, env: %v", lib.Env)
+	}
+	content, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "x"); n != 1 {
+		t.Fatalf("built %d times, want 1", n)
+	}
+
+	// The token is only sent to a configured store
+	t.Setenv(EnvPrebuiltURL, "")
+	if (Config{}).downloadAuth() != nil {
+		t.Fatal("download token sent to the default releases")
+	}
+	t.Setenv(EnvPrebuiltURL, config.PrebuiltURL)
+	if (Config{}).downloadAuth() == nil {
+		t.Fatalf("no download token for $%s", EnvPrebuiltURL)
+	}
+}
+
+func TestPublishToPath(t *testing.T) {
+	lib := &Lib{ModName: "example.com/fs", Config: LibSpec{Name: "fs", Version: "1.0"}}
+	dist := t.TempDir()
+	buildDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(buildDir, "libfs.a"), []byte("lib"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dist, prebuiltArchiveName(lib.Config, "x86_64-unknown-linux"))
+	// An archive of another version whose name starts like those of 1.0
+	rc := filepath.Join(dist, prebuiltArchiveName(LibSpec{Name: "fs", Version: "1.0-rc1"}, "x86_64-unknown-linux"))
+	for _, path := range []string{archive, rc} {
+		if _, err := writeArchive(buildDir, "x86_64-unknown-linux", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dest := t.TempDir()
+	published, err := Publish(context.Background(), Config{Logger: Discard}, []*Lib{lib}, dist, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || path.Base(published[0]) != filepath.Base(archive) {
+		t.Fatalf("published %q, want only %s", published, filepath.Base(archive))
+	}
+	for _, name := range []string{filepath.Base(archive), filepath.Base(archive) + SumExt, SumsFile} {
+		if _, err := os.Stat(filepath.Join(dest, "fs", "1.0", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDownloadChecksumErrors(t *testing.T) {
+	store := &memStore{files: make(map[string][]byte), status: make(map[string]int)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	lib := &Lib{
+		ModName: "example.com/strict",
+		Path:    t.TempDir(),
+		Sum:     "h1:strict",
+		Config: LibSpec{
+			Name:    "strict",
+			Version: "1.0",
+			Build:   &BuildSpec{Command: `echo lib > "$CLIBS_BUILD_DIR/libstrict.a"`},
+		},
+	}
+	ctx := context.Background()
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	dist := t.TempDir()
+	if _, err := Package(ctx, config, []*Lib{lib}, dist); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Publish(ctx, config, []*Lib{lib}, dist, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	release := "/strict/1.0/"
+	archive := release + prebuiltArchiveName(lib.Config, "x86_64-unknown-linux")
+
+	config.PrebuiltURL = server.URL
+	config.PrebuiltPolicy = PrebuiltRequire
+
+	// A sums file that exists but fails to load does not skip the check
+	store.status[release+SumsFile] = http.StatusInternalServerError
+	config.CacheDir = t.TempDir()
+	if err := BuildContext(ctx, config, []*Lib{lib}); err == nil || !strings.Contains(err.Error(), "failed to load") {
+		t.Fatalf("download with a failing %s: got %v", SumsFile, err)
+	}
+	delete(store.status, release+SumsFile)
+
+	// Unlisted archives are only refused when checksums are required
+	delete(store.files, archive+SumExt)
+	delete(store.files, release+SumsFile)
+	config.RequireChecksum = true
+	config.CacheDir = t.TempDir()
+	if err := BuildContext(ctx, config, []*Lib{lib}); !errors.Is(err, ErrNoChecksum) {
+		t.Fatalf("download of an unlisted archive: got %v, want ErrNoChecksum", err)
+	}
+	config.RequireChecksum = false
+	config.CacheDir = t.TempDir()
+	if err := BuildContext(ctx, config, []*Lib{lib}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,202 @@
+package clibs
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SignatureExt is appended to the archive name for its detached
+	// signature
+	SignatureExt = ".sig"
+	// ProjectKeysFile lists the public keys trusted by a project. It lives
+	// next to the go.mod of the project.
+	ProjectKeysFile = "clibs.keys"
+	// VerificationFile records in a prebuilt dir how the archive it was
+	// extracted from was verified
+	VerificationFile = "_llgo_clib_verification.json"
+)
+
+// ErrUnsigned is returned when a required signature is missing
+var ErrUnsigned = errors.New("archive is not signed")
+
+// signedMessage is what gets signed for an archive: its SumsFile line, so
+// a signature cannot be reused for another archive name
+func signedMessage(name, sum string) []byte {
+	return []byte(fmt.Sprintf("%s  %s\n", sum, name))
+}
+
+// signArchive writes the detached signature of the archive with sha256 sum
+func signArchive(key ed25519.PrivateKey, archive, sum string) error {
+	sig := ed25519.Sign(key, signedMessage(filepath.Base(archive), sum))
+	return os.WriteFile(archive+SignatureExt, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644)
+}
+
+// verifySignature checks sig of the archive name with sha256 sum against
+// keys
+func verifySignature(keys []ed25519.PublicKey, name, sum string, sig []byte) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+	msg := signedMessage(name, sum)
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, raw) {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signature of %s does not match any trusted key", name)
+}
+
+// archiveVerification is the content of VerificationFile
+type archiveVerification struct {
+	Archive string `json:"archive"`
+	Sha256  string `json:"sha256"`
+	// Signature and Key are the detached signature of the archive and the
+	// trusted key it was verified with, empty for unverified signatures
+	Signature string `json:"signature,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// writeVerification writes the VerificationFile of an extracted archive
+func writeVerification(dir string, v archiveVerification) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, VerificationFile), append(content, '\n'), 0644)
+}
+
+// checkVerification checks that the prebuilt dir was extracted from an
+// archive signed by a currently trusted key, if signatures are required.
+// The signature is verified again, so editing the record does not help.
+func (c Config) checkVerification(dir string) error {
+	if !c.requireSignature() {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(dir, VerificationFile))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: no signature recorded in %s", ErrUnsigned, dir)
+	} else if err != nil {
+		return err
+	}
+	var v archiveVerification
+	if err := json.Unmarshal(content, &v); err != nil {
+		return fmt.Errorf("invalid %s in %s: %v", VerificationFile, dir, err)
+	}
+	if v.Signature == "" || v.Key == "" {
+		return fmt.Errorf("%w: %s was not verified with a trusted key", ErrUnsigned, v.Archive)
+	}
+	keys, err := c.trustedKeys()
+	if err != nil {
+		return err
+	}
+	key, err := verifySignature(keys, v.Archive, v.Sha256, []byte(v.Signature))
+	if err != nil {
+		return err
+	}
+	if base64.StdEncoding.EncodeToString(key) != v.Key {
+		return fmt.Errorf("signature of %s recorded for another key", v.Archive)
+	}
+	return nil
+}
+
+// GenerateKey creates an ed25519 key pair, encoding the private key as
+// PKCS #8 PEM and the public key in the format of trusted key files
+func GenerateKey() (privatePEM []byte, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", err
+	}
+	privatePEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return privatePEM, base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// LoadSigningKey reads a PKCS #8 PEM encoded ed25519 private key, as
+// written by GenerateKey or `openssl genpkey -algorithm ed25519`
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// ParseTrustedKeys parses a trusted key file: one base64 encoded ed25519
+// public key per line, optionally followed by a comment. Blank lines and
+// lines starting with # are ignored.
+func ParseTrustedKeys(content []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		field, _, _ := strings.Cut(line, " ")
+		raw, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("line %d: not a base64 ed25519 public key", n)
+		}
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+	return keys, scanner.Err()
+}
+
+// trustedKeys returns config.TrustedKeys plus the keys of the user file
+// ~/.llgo/clibs_trusted_keys and the ProjectKeysFile of the project
+func (c Config) trustedKeys() ([]ed25519.PublicKey, error) {
+	keys := append([]ed25519.PublicKey(nil), c.TrustedKeys...)
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".llgo", "clibs_trusted_keys"))
+	}
+	if root, ok := c.projectRoot(); ok {
+		files = append(files, filepath.Join(root, ProjectKeysFile))
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		fileKeys, err := ParseTrustedKeys(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	return keys, nil
+}
+
+// requireSignature reports whether unsigned archives are refused
+func (c Config) requireSignature() bool {
+	return c.RequireSignature || os.Getenv(EnvRequireSignature) == "1"
+}
@@ -0,0 +1,86 @@
+package clibs
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadPrebuiltVerifiesSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), SigningKey: priv, Logger: Discard}
+	lib := testPrebuiltLib(t, "1.0")
+	config.PrebuiltURL = publishTestLib(t, lib, config)
+	config.SigningKey = nil
+	sig := filepath.Join(config.PrebuiltURL, "verified", "1.0", prebuiltArchiveName(lib.Config, "x86_64-unknown-linux")+SignatureExt)
+	if _, err := os.Stat(sig); err != nil {
+		t.Fatalf("signature not published: %v", err)
+	}
+
+	config.CacheDir = t.TempDir()
+	config.TrustedKeys = []ed25519.PublicKey{other}
+	if _, err := lib.tryDownloadPrebuilt(context.Background(), config); err == nil || !strings.Contains(err.Error(), "trusted key") {
+		t.Fatalf("archive signed by an untrusted key accepted: %v", err)
+	}
+
+	config.TrustedKeys = append(config.TrustedKeys, pub)
+	config.RequireSignature = true
+	if _, err := lib.tryDownloadPrebuilt(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	// The signature is recorded, so the extracted dir is reused
+	if dir, err := lib.checkPrebuiltStatus(config); err != nil || dir == "" {
+		t.Fatalf("signed prebuilt lib not reused: %q, %v", dir, err)
+	}
+
+	config.CacheDir = t.TempDir()
+	os.Remove(sig)
+	if _, err := lib.tryDownloadPrebuilt(context.Background(), config); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("unsigned archive accepted: %v", err)
+	}
+
+	// An unsigned archive downloaded before signatures were required is
+	// not reused afterwards
+	config.RequireSignature = false
+	if _, err := lib.tryDownloadPrebuilt(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := lib.checkPrebuiltStatus(config); err != nil || dir == "" {
+		t.Fatalf("unsigned prebuilt lib not reused: %q, %v", dir, err)
+	}
+	config.RequireSignature = true
+	if dir, err := lib.checkPrebuiltStatus(config); err != nil || dir != "" {
+		t.Fatalf("unsigned prebuilt lib reused with signatures required: %q, %v", dir, err)
+	}
+	config.PrebuiltPolicy = PrebuiltRequire
+	if err := BuildContext(context.Background(), config, []*Lib{lib}); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("build with signatures required: got %v, want ErrUnsigned", err)
+	}
+}
+
+func TestParseTrustedKeys(t *testing.T) {
+	_, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseTrustedKeys([]byte("# release keys\n\n" + public + " ci@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(keys))
+	}
+	if _, err := ParseTrustedKeys([]byte("not-a-key\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("malformed key accepted: %v", err)
+	}
+}
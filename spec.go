@@ -1,11 +1,19 @@
 package clibs
 
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"time"
+)
+
 // StatusFile constants for tracking library status
 const (
 	BuildDirName    = "_build"
 	DownloadDirName = "_download"
 	PrebuiltDirName = "_prebuilt"
 	BuildHashFile   = "_llgo_clib_build_config_hash.json"
+	LastUseFile     = "_llgo_clib_last_use"
 
 	LibConfigFile = "lib.yaml"
 
@@ -22,6 +30,29 @@ const (
 	EnvBuildCflags  = "CLIBS_BUILD_CFLAGS"
 	EnvBuildLdflags = "CLIBS_BUILD_LDFLAGS"
 	EnvBuildDir     = "CLIBS_BUILD_DIR"
+	EnvBuildProfile = "CLIBS_BUILD_PROFILE"
+)
+
+// Environment variables read by the library
+const (
+	EnvCacheDir  = "CLIBS_CACHE_DIR"
+	EnvOutOfTree = "CLIBS_OUT_OF_TREE"
+
+	// EnvPrebuiltURL is the base URL or path of the prebuilt artifact store
+	EnvPrebuiltURL = "CLIBS_PREBUILT_URL"
+	// EnvPublishToken is sent as bearer token when publishing over HTTP
+	EnvPublishToken = "CLIBS_PUBLISH_TOKEN"
+	// EnvDownloadToken is sent as bearer token when downloading prebuilt
+	// archives from the artifact store over HTTP
+	EnvDownloadToken = "CLIBS_DOWNLOAD_TOKEN"
+	// EnvRequireSignature refuses unsigned prebuilt archives when set to 1
+	EnvRequireSignature = "CLIBS_REQUIRE_SIGNATURE"
+	// EnvRequireChecksum refuses prebuilt archives whose sha256 is not
+	// published when set to 1
+	EnvRequireChecksum = "CLIBS_REQUIRE_CHECKSUM"
+	// EnvNoListCache disables caching the modules found by ListLibs when
+	// set to 1
+	EnvNoListCache = "CLIBS_NO_LIST_CACHE"
 )
 
 type GitSpec struct {
@@ -39,6 +70,21 @@ type BuildSpec struct {
 	Command string `json:"command,omitempty" yaml:"command,omitempty"`
 }
 
+// PkgConfigSpec describes the pkg-config file generated for a lib. Libs
+// and Cflags may use the pkg-config variables ${prefix}, ${libdir} and
+// ${includedir} of the build dir.
+type PkgConfigSpec struct {
+	// Name of the .pc file, defaults to the lib name
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Libs defaults to "-L${libdir} -l<name>"
+	Libs string `json:"libs,omitempty" yaml:"libs,omitempty"`
+	// Cflags defaults to "-I${includedir}"
+	Cflags string `json:"cflags,omitempty" yaml:"cflags,omitempty"`
+	// Requires are pkg-config names of other libs, such as other clibs
+	Requires []string `json:"requires,omitempty" yaml:"requires,omitempty"`
+}
+
 type LibSpec struct {
 	Name    string     `json:"name,omitempty" yaml:"name,omitempty"`
 	Version string     `json:"version,omitempty" yaml:"version,omitempty"`
@@ -46,12 +92,21 @@ type LibSpec struct {
 	Files   []FileSpec `json:"files,omitempty" yaml:"files,omitempty"`
 	Build   *BuildSpec `json:"build,omitempty" yaml:"build,omitempty"`
 	Export  string     `json:"export,omitempty" yaml:"export,omitempty"`
+	// Exports maps variable names to templates over the build env, such
+	// as "${CLIBS_BUILD_DIR}/include". They are exported before the
+	// output of the Export script.
+	Exports map[string]string `json:"exports,omitempty" yaml:"exports,omitempty"`
+	// PkgConfig generates lib/pkgconfig/<name>.pc in the build dir unless
+	// the build installs one
+	PkgConfig *PkgConfigSpec `json:"pkgconfig,omitempty" yaml:"pkgconfig,omitempty"`
 }
 
 func (c *LibSpec) DownloadHash() LibSpec {
 	hashConfig := *c
 	hashConfig.Build = nil
 	hashConfig.Export = ""
+	hashConfig.Exports = nil
+	hashConfig.PkgConfig = nil
 	return hashConfig
 }
 
@@ -72,8 +127,81 @@ type Lib struct {
 type Config struct {
 	Goos     string
 	Goarch   string
+	Profile  Profile
 	Prebuilt bool
 	Force    bool
 	Verbose  bool
 	Tags     []string
+
+	// Targets are built by BuildContext instead of Goos and Goarch
+	Targets []Target
+
+	// CompileCommands records the compiler invocations of builds into a
+	// compile_commands.json in the build dir, by wrapping CC and CXX
+	CompileCommands bool
+
+	// CacheDir is the root of the shared build cache, defaults to
+	// $CLIBS_CACHE_DIR or ~/.llgo/clibs_build
+	CacheDir string
+
+	// OutOfTree keeps the build state of local modules, which have no sum,
+	// in the cache instead of their source dir. Also enabled by setting
+	// $CLIBS_OUT_OF_TREE to 1.
+	OutOfTree bool
+
+	// PrebuiltURL is the base URL or path of the prebuilt artifact store,
+	// laid out as <name>/<version>/<archive>. Defaults to $CLIBS_PREBUILT_URL
+	// or the GitHub releases of ReleaseUrlPrefix.
+	PrebuiltURL string
+
+	// PrebuiltPolicy selects whether prebuilt archives are used, defaults
+	// to PrebuiltPrefer
+	PrebuiltPolicy PrebuiltPolicy
+
+	// SigningKey signs the archives written by Package
+	SigningKey ed25519.PrivateKey
+	// TrustedKeys are trusted to sign prebuilt archives, in addition to
+	// the keys of ~/.llgo/clibs_trusted_keys and the project clibs.keys
+	TrustedKeys []ed25519.PublicKey
+	// RequireSignature refuses prebuilt archives without a signature of a
+	// trusted key. Also enabled by setting $CLIBS_REQUIRE_SIGNATURE to 1.
+	RequireSignature bool
+	// RequireChecksum refuses prebuilt archives whose sha256 is listed in
+	// no sum file of the store or project. Also enabled by setting
+	// $CLIBS_REQUIRE_CHECKSUM to 1.
+	RequireChecksum bool
+
+	// Dir is the Go project dir libs are listed from, defaults to the
+	// current directory
+	Dir string
+
+	// StepTimeout limits each fetch, build, export and list step
+	StepTimeout time.Duration
+
+	// Logger receives progress and diagnostics, defaults to text on stderr
+	// at info level, or debug level if Verbose is set
+	Logger Logger
+}
+
+// Target is a GOOS/GOARCH pair to build libs for
+type Target struct {
+	Goos   string
+	Goarch string
+}
+
+func (t Target) String() string {
+	return t.Goos + "/" + t.Goarch
+}
+
+// ParseTargets parses a comma-separated list of GOOS/GOARCH targets
+func ParseTargets(list string) ([]Target, error) {
+	var targets []Target
+	for _, s := range strings.Split(list, ",") {
+		goos, goarch, ok := strings.Cut(strings.TrimSpace(s), "/")
+		if !ok || goos == "" || goarch == "" {
+			return nil, fmt.Errorf("invalid target %q, expected GOOS/GOARCH", s)
+		}
+		targets = append(targets, Target{Goos: goos, Goarch: goarch})
+	}
+	return targets, nil
 }
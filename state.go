@@ -0,0 +1,255 @@
+package clibs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// BuildStateVersion is the schema version written to BuildHashFile.
+// Files without a version field are legacy raw LibSpec dumps (version 0).
+const BuildStateVersion = 1
+
+const modulePath = "github.com/cpunion/clibs"
+
+// StateInputs holds everything that determines the content of a download
+// or build directory. Its digest decides whether a directory can be reused.
+type StateInputs struct {
+	Spec    LibSpec `json:"spec"`
+	Profile Profile `json:"profile,omitempty"`
+}
+
+// StateHost describes the machine that produced a directory.
+type StateHost struct {
+	Hostname string `json:"hostname,omitempty"`
+	OS       string `json:"os,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+}
+
+// BuildState is the content of BuildHashFile.
+type BuildState struct {
+	Version     int         `json:"version"`
+	Digest      string      `json:"digest"`
+	Inputs      StateInputs `json:"inputs"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	ToolVersion string      `json:"tool_version,omitempty"`
+	Host        StateHost   `json:"host"`
+}
+
+// Digest returns the content digest of the normalized inputs. Empty values
+// are dropped before hashing, so adding an optional field that is unset
+// does not change the digest of existing specs.
+func (in StateInputs) Digest() (string, error) {
+	return digestOf(in)
+}
+
+// digestOf returns the sha256 of the canonical JSON encoding of v
+func digestOf(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "", err
+	}
+	// Marshaling a map sorts the keys, which makes the encoding canonical
+	data, err = json.Marshal(normalizeValue(decoded))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// normalizeValue drops zero values from decoded JSON recursively
+func normalizeValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			if n := normalizeValue(e); n != nil {
+				out[k] = n
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case []any:
+		if len(v) == 0 {
+			return nil
+		}
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalizeValue(e)
+		}
+		return out
+	case string:
+		if v == "" {
+			return nil
+		}
+	case bool:
+		if !v {
+			return nil
+		}
+	case float64:
+		if v == 0 {
+			return nil
+		}
+	}
+	return v
+}
+
+// buildInputs returns the inputs of a build directory. Release is stored
+// as the empty profile so existing release caches stay valid.
+func buildInputs(config LibSpec, profile Profile) StateInputs {
+	inputs := StateInputs{Spec: config.BuildHash()}
+	if profile = profile.normalize(); profile != ProfileRelease {
+		inputs.Profile = profile
+	}
+	return inputs
+}
+
+// downloadInputs returns the inputs of the download directory
+func downloadInputs(config LibSpec) StateInputs {
+	return StateInputs{Spec: config.DownloadHash()}
+}
+
+// newBuildState creates a state for inputs produced on this host
+func newBuildState(inputs StateInputs) (*BuildState, error) {
+	digest, err := inputs.Digest()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	return &BuildState{
+		Version:     BuildStateVersion,
+		Digest:      digest,
+		Inputs:      inputs,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ToolVersion: toolVersion(),
+		Host: StateHost{
+			Hostname: hostname,
+			OS:       runtime.GOOS,
+			Arch:     runtime.GOARCH,
+		},
+	}, nil
+}
+
+// ReadBuildState reads the state file in dir, converting legacy files
+// into the current in-memory representation.
+func ReadBuildState(dir string) (*BuildState, error) {
+	path := filepath.Join(dir, BuildHashFile)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseBuildState(content, path)
+}
+
+func parseBuildState(content []byte, path string) (*BuildState, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(content, &probe); err != nil {
+		return nil, fmt.Errorf("invalid build state %s: %v", path, err)
+	}
+
+	// Legacy specs have a string "version", states have a numeric one
+	var version int
+	if json.Unmarshal(probe["version"], &version) == nil {
+		// Unknown fields written by newer versions are ignored
+		var state BuildState
+		if err := json.Unmarshal(content, &state); err != nil {
+			return nil, fmt.Errorf("invalid build state %s: %v", path, err)
+		}
+		return &state, nil
+	}
+
+	// Legacy format: the raw LibSpec JSON
+	var spec LibSpec
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return nil, fmt.Errorf("invalid legacy build state %s: %v", path, err)
+	}
+	inputs := StateInputs{Spec: spec}
+	digest, err := inputs.Digest()
+	if err != nil {
+		return nil, err
+	}
+	state := &BuildState{Version: 0, Digest: digest, Inputs: inputs}
+	if fi, err := os.Stat(path); err == nil {
+		state.CreatedAt = fi.ModTime().UTC()
+		state.UpdatedAt = state.CreatedAt
+	}
+	return state, nil
+}
+
+// writeBuildState writes state to dir
+func writeBuildState(dir string, state *BuildState) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, BuildHashFile), buf.Bytes(), 0644)
+}
+
+// normalizedBuildState returns the state file in dir without the build
+// times and hostname, for archives that must not depend on them
+func normalizedBuildState(dir string) ([]byte, error) {
+	state, err := ReadBuildState(dir)
+	if err != nil {
+		return nil, err
+	}
+	state.CreatedAt, state.UpdatedAt = time.Time{}, time.Time{}
+	state.Host.Hostname = ""
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// migrateBuildState rewrites an older state file in the current format,
+// keeping its original timestamps.
+func migrateBuildState(dir string, old *BuildState) error {
+	state, err := newBuildState(old.Inputs)
+	if err != nil {
+		return err
+	}
+	if !old.CreatedAt.IsZero() {
+		state.CreatedAt = old.CreatedAt
+	}
+	state.ToolVersion = old.ToolVersion
+	state.Host = old.Host
+	return writeBuildState(dir, state)
+}
+
+// toolVersion returns the version of the clibs module in this binary
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package clibs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHashMigratesLegacyState(t *testing.T) {
+	dir := t.TempDir()
+	spec := LibSpec{
+		Name:    "bdwgc",
+		Version: "v8.2.8",
+		Files:   []FileSpec{{URL: "https://example.com/bdwgc.tar.gz"}},
+		Build:   &BuildSpec{Command: "make"},
+	}
+
+	// Legacy state files are the indented LibSpec JSON
+	legacy, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, BuildHashFile), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	matched, err := checkHash(Config{Logger: Discard}.libLogger(nil), dir, buildInputs(spec, ProfileRelease))
+	if err != nil || !matched {
+		t.Fatalf("checkHash(legacy) = %v, %v, want true, nil", matched, err)
+	}
+
+	state, err := ReadBuildState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != BuildStateVersion {
+		t.Errorf("state version after migration = %d, want %d", state.Version, BuildStateVersion)
+	}
+	if !strings.HasPrefix(state.Digest, "sha256:") {
+		t.Errorf("unexpected digest %q", state.Digest)
+	}
+
+	spec.Version = "v8.2.9"
+	if matched, _ := checkHash(Config{Logger: Discard}.libLogger(nil), dir, buildInputs(spec, ProfileRelease)); matched {
+		t.Errorf("checkHash matched after version change")
+	}
+}
+
+func TestCheckHashIgnoresUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	spec := LibSpec{Name: "zlib", Version: "1.3.1"}
+	if err := saveHash(dir, buildInputs(spec, ProfileRelease)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a state written by a newer tool with extra fields
+	path := filepath.Join(dir, BuildHashFile)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(content, &raw); err != nil {
+		t.Fatal(err)
+	}
+	raw["version"] = BuildStateVersion + 1
+	raw["future_field"] = "value"
+	raw["inputs"].(map[string]any)["spec"].(map[string]any)["future-option"] = ""
+	content, err = json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if matched, err := checkHash(Config{Logger: Discard}.libLogger(nil), dir, buildInputs(spec, ProfileRelease)); err != nil || !matched {
+		t.Fatalf("checkHash(newer state) = %v, %v, want true, nil", matched, err)
+	}
+}
+
+func TestStateDigestIgnoresEmptyFields(t *testing.T) {
+	a, err := StateInputs{Spec: LibSpec{Name: "a", Git: &GitSpec{}}}.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := StateInputs{Spec: LibSpec{Name: "a"}}.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("digest changed by empty field: %s != %s", a, b)
+	}
+}
+
+func TestDiffInputs(t *testing.T) {
+	old := StateInputs{Spec: LibSpec{
+		Name:    "bdwgc",
+		Version: "v8.2.8",
+		Git:     &GitSpec{Repo: "https://github.com/ivmai/bdwgc.git", Ref: "v8.2.8"},
+	}}
+	cur := StateInputs{
+		Spec: LibSpec{
+			Name:    "bdwgc",
+			Version: "v8.2.9",
+			Git:     &GitSpec{Repo: "https://github.com/ivmai/bdwgc.git"},
+		},
+		Profile: ProfileDebug,
+	}
+	got := diffInputs(old, cur)
+	want := []string{
+		`+ profile: "debug"`,
+		`- spec.git.ref: "v8.2.8"`,
+		`~ spec.version: "v8.2.8" -> "v8.2.9"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diffInputs() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package clibs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DirState is the state of a download, build or prebuilt directory
+type DirState string
+
+const (
+	DirPresent DirState = "present"
+	DirStale   DirState = "stale"
+	DirMissing DirState = "missing"
+)
+
+// DirInfo describes one directory of a lib's build state
+type DirInfo struct {
+	// Kind is DownloadDirName, BuildDirName or PrebuiltDirName
+	Kind string
+	// Target is the target directory name, empty for downloads
+	Target  string
+	Dir     string
+	State   DirState
+	Reason  string
+	Size    int64
+	ModTime time.Time
+}
+
+// LibStatus is the build state of a lib
+type LibStatus struct {
+	Lib     *Lib
+	BaseDir string
+	Dirs    []DirInfo
+}
+
+// Status inspects the download dir and every build and prebuilt target
+// directory of libs. The target of config is always reported, so it shows
+// up as missing when it was never built.
+func Status(config Config, libs []*Lib) ([]LibStatus, error) {
+	if config.Goos == "" {
+		config.Goos = runtime.GOOS
+	}
+	if config.Goarch == "" {
+		config.Goarch = runtime.GOARCH
+	}
+	current := getTargetDirName(getTargetTriple(config.Goos, config.Goarch), config.Profile)
+
+	var statuses []LibStatus
+	for _, lib := range libs {
+		baseDir, err := getBuildBaseDir(config, lib)
+		if err != nil {
+			return nil, newError(lib, "", PhaseBuild, err)
+		}
+		status := LibStatus{Lib: lib, BaseDir: baseDir}
+		status.Dirs = append(status.Dirs, inspectDirInfo(DownloadDirName, "", filepath.Join(baseDir, DownloadDirName), downloadInputs(lib.Config)))
+
+		for _, kind := range []string{BuildDirName, PrebuiltDirName} {
+			targets := map[string]bool{current: true}
+			if entries, err := os.ReadDir(filepath.Join(baseDir, kind)); err == nil {
+				for _, entry := range entries {
+					// Build dirs of versioned modules link to the store
+					if fi, err := os.Stat(filepath.Join(baseDir, kind, entry.Name())); err == nil && fi.IsDir() {
+						targets[entry.Name()] = true
+					}
+				}
+			}
+			names := make([]string, 0, len(targets))
+			for name := range targets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				_, profile := parseTargetDirName(name)
+				dir := filepath.Join(baseDir, kind, name)
+				status.Dirs = append(status.Dirs, inspectDirInfo(kind, name, dir, buildInputs(lib.Config, profile)))
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func inspectDirInfo(kind, target, dir string, inputs StateInputs) DirInfo {
+	info := DirInfo{Kind: kind, Target: target, Dir: dir}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		info.State = DirMissing
+		return info
+	}
+	info.ModTime = fi.ModTime()
+	info.Size = dirSize(dir)
+
+	status := inspectDir(dir, inputs)
+	if status.State != nil && !status.State.UpdatedAt.IsZero() {
+		info.ModTime = status.State.UpdatedAt
+	}
+	if status.OK {
+		info.State = DirPresent
+	} else {
+		info.State = DirStale
+		info.Reason = status.Reason
+	}
+	return info
+}
+
+// parseTargetDirName splits a target directory name into triple and profile
+func parseTargetDirName(name string) (string, Profile) {
+	for profile := range profiles {
+		if suffix := "-" + string(profile); profile != ProfileRelease && strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), profile
+		}
+	}
+	return name, ProfileRelease
+}
+
+// dirSize returns the total size of regular files under dir, following
+// dir itself if it links to the store
+func dirSize(dir string) int64 {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// LibInfo is the detailed view of a lib for the current target
+type LibInfo struct {
+	Lib      *Lib
+	BuildDir string
+	Built    bool
+	Env      []string
+	Exports  []string
+}
+
+// resolveDir returns the directory Build would use without building:
+// the prebuilt dir when valid, otherwise the build dir.
+func (lib *Lib) resolveDir(config Config) (dir string, built bool, err error) {
+	targetDirName := getTargetDirName(getTargetTriple(config.Goos, config.Goarch), config.Profile)
+	inputs := buildInputs(lib.Config, config.Profile)
+	if config.Prebuilt {
+		// Built into the prebuilt dir for packaging
+		prebuiltDir, err := getBuildDirByName(config, lib, PrebuiltDirName, targetDirName)
+		if err != nil {
+			return "", false, err
+		}
+		return prebuiltDir, inspectDir(prebuiltDir, inputs).OK, nil
+	}
+	config.Force = false
+	if lib.prebuiltSkipReason(config) == "" {
+		prebuiltDir, err := getBuildDirByName(config, lib, PrebuiltDirName, targetDirName)
+		if err != nil {
+			return "", false, err
+		}
+		if inspectDir(prebuiltDir, inputs).OK && config.checkVerification(prebuiltDir) == nil {
+			return prebuiltDir, true, nil
+		}
+	}
+	buildDir, err := getBuildDirByName(config, lib, BuildDirName, targetDirName)
+	if err != nil {
+		return "", false, err
+	}
+	return buildDir, inspectDir(buildDir, inputs).OK, nil
+}
+
+// Info resolves the build dir and env of lib for the target of config and
+// runs its export script when the lib has been built.
+func (lib *Lib) Info(ctx context.Context, config Config) (*LibInfo, error) {
+	config = config.buildDefaults()
+	targetTriple := getTargetTriple(config.Goos, config.Goarch)
+
+	dir, built, err := lib.resolveDir(config)
+	if err != nil {
+		return nil, newError(lib, targetTriple, PhaseExport, err)
+	}
+	env, err := getBuildEnv(config, lib, dir)
+	if err != nil {
+		return nil, newError(lib, targetTriple, PhaseExport, err)
+	}
+	info := &LibInfo{Lib: lib, BuildDir: dir, Built: built, Env: env}
+	if built {
+		lib.Env = env
+		if info.Exports, err = lib.ExportContext(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
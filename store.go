@@ -0,0 +1,253 @@
+package clibs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// StoreDirName is the dir of the cache holding build outputs keyed by
+// their inputs. Module paths cannot start with a dot, so it never clashes
+// with a module dir.
+const StoreDirName = ".store"
+
+// storeLockExt is appended to a store dir for the lock file serializing
+// its builds
+const storeLockExt = ".lock"
+
+// storeInputs identify a build output independently of the module version
+// that requested it
+type storeInputs struct {
+	Inputs StateInputs `json:"inputs"`
+	Target string      `json:"target"`
+	// Files maps the files of the module that build scripts can read from
+	// $CLIBS_PACKAGE_DIR, e.g. patches, to their sha256
+	Files map[string]string `json:"files,omitempty"`
+	// Toolchain is the version banner of the C compilers
+	Toolchain string `json:"toolchain,omitempty"`
+}
+
+// getStoreDir returns the store dir of the build of lib for the target and
+// profile of config
+func getStoreDir(ctx context.Context, config Config, lib *Lib) (string, error) {
+	root, err := config.cacheRoot()
+	if err != nil {
+		return "", err
+	}
+	files, err := packageDigests(lib.Path)
+	if err != nil {
+		return "", err
+	}
+	digest, err := digestOf(storeInputs{
+		Inputs:    buildInputs(lib.Config, config.Profile),
+		Target:    getTargetTriple(config.Goos, config.Goarch),
+		Files:     files,
+		Toolchain: toolchainFingerprint(ctx, config),
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, StoreDirName, strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+// packageDigests hashes the files of a module that build scripts can read.
+// lib.yaml is left out as its build inputs are part of the state, and so
+// are the Go sources and go.mod/go.sum, so that versions only changing Go
+// code share builds, and the _download, _build and _prebuilt dirs.
+func packageDigests(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != dir && (strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || isModuleMetadata(dir, path) {
+			return nil
+		}
+		_, sum, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash package files: %v", err)
+	}
+	return files, nil
+}
+
+// isModuleMetadata reports whether path is lib.yaml or a Go file of the
+// module in dir
+func isModuleMetadata(dir, path string) bool {
+	switch rel, _ := filepath.Rel(dir, path); rel {
+	case "lib.yaml", "go.mod", "go.sum":
+		return true
+	}
+	return filepath.Ext(path) == ".go"
+}
+
+var toolchainCache sync.Map
+
+// toolchainFingerprint returns the resolved path and first line of
+// `--version` of the compilers builds use: $CC and $CXX, defaulting to cc
+// and c++, and clang when cross compiling. Missing compilers are skipped.
+func toolchainFingerprint(ctx context.Context, config Config) string {
+	var compilers []string
+	for _, v := range [][2]string{{"CC", "cc"}, {"CXX", "c++"}} {
+		if cc := os.Getenv(v[0]); cc != "" {
+			compilers = append(compilers, cc)
+		} else {
+			compilers = append(compilers, v[1])
+		}
+	}
+	if config.Goos != runtime.GOOS || config.Goarch != runtime.GOARCH {
+		compilers = append(compilers, "clang")
+	}
+	var banners []string
+	for _, cc := range compilers {
+		if banner := compilerBanner(ctx, config, cc); banner != "" {
+			banners = append(banners, banner)
+		}
+	}
+	return strings.Join(banners, "; ")
+}
+
+// compilerBanner returns the resolved path and version banner of cc
+func compilerBanner(ctx context.Context, config Config, cc string) string {
+	if v, ok := toolchainCache.Load(cc); ok {
+		return v.(string)
+	}
+	fields := strings.Fields(cc)
+	if len(fields) == 0 {
+		return ""
+	}
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	ctx, cancel := config.stepContext(ctx)
+	defer cancel()
+	out, err := commandContext(ctx, fields[0], append(fields[1:], "--version")...).Output()
+	if err != nil {
+		// Not cached, a cancelled probe is retried
+		return ""
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	banner := path + " " + version
+	toolchainCache.Store(cc, banner)
+	return banner
+}
+
+// linkStoreDir points dir at storeDir, replacing whatever dir was
+func linkStoreDir(storeDir, dir string) error {
+	if target, err := os.Readlink(dir); err == nil && target == storeDir {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(storeDir, dir)
+}
+
+// canSymlink reports whether symlinks can be created in dir
+func canSymlink(dir string) bool {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false
+	}
+	probe, err := os.MkdirTemp(dir, ".symlink-")
+	if err != nil {
+		return false
+	}
+	os.Remove(probe)
+	if err := os.Symlink(dir, probe); err != nil {
+		return false
+	}
+	os.Remove(probe)
+	return true
+}
+
+// tryStoreBuild reuses or builds the output of lib in the store and links
+// buildDir to it. It returns false when the store cannot be used, e.g. on
+// file systems without symlinks, and the caller builds in place. Builds of
+// the same store dir are serialized by a lock file next to it, and buildDir
+// is only linked once the build state is saved, so a failed build is never
+// trusted by other module versions.
+func (lib *Lib) tryStoreBuild(ctx context.Context, config Config, buildDir string) (bool, error) {
+	log := config.libLogger(lib)
+	storeDir, err := getStoreDir(ctx, config, lib)
+	if err != nil {
+		return false, err
+	}
+	inputs := buildInputs(lib.Config, config.Profile)
+	reuse := func() bool {
+		matched, err := checkHash(log, storeDir, inputs)
+		return err == nil && matched && verifyOutputs(storeDir) == nil && config.hasCompileCommands(storeDir)
+	}
+	link := func() (bool, error) {
+		if err := linkStoreDir(storeDir, buildDir); err != nil {
+			log.debugf("Cannot link %s to %s: %v", buildDir, storeDir, err)
+			return false, nil
+		}
+		return true, nil
+	}
+	if !config.Force && reuse() {
+		log.infof("reusing identical build in %s", storeDir)
+		return link()
+	}
+
+	// Probe symlink support before spending time on the build
+	if !canSymlink(filepath.Dir(buildDir)) {
+		log.debugf("Cannot create symlinks in %s", filepath.Dir(buildDir))
+		return false, nil
+	}
+	// The old build is stale, never leave it behind a failed build
+	if err := os.RemoveAll(buildDir); err != nil {
+		return true, err
+	}
+	if err := os.MkdirAll(filepath.Dir(storeDir), 0755); err != nil {
+		return true, err
+	}
+	unlock, err := lockFile(ctx, storeDir+storeLockExt)
+	if err != nil {
+		return true, fmt.Errorf("failed to lock %s: %w", storeDir, err)
+	}
+	defer unlock()
+	// Built by another module version while waiting for the lock
+	if !config.Force && reuse() {
+		log.infof("reusing identical build in %s", storeDir)
+		return link()
+	}
+	if err := lib.fetchAndBuild(ctx, config, storeDir); err != nil {
+		return true, err
+	}
+	if err := linkStoreDir(storeDir, buildDir); err != nil {
+		return true, fmt.Errorf("failed to link %s to %s: %v", buildDir, storeDir, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,172 @@
+package clibs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreSharesBuilds(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "builds")
+	spec := LibSpec{
+		Name:    "shared",
+		Version: "1.0",
+		Build: &BuildSpec{
+			Command: `echo lib > "$CLIBS_BUILD_DIR/libshared.a"; echo x >> ` + counter,
+		},
+	}
+	var libs []*Lib
+	for _, sum := range []string{"h1:v010", "h1:v011"} {
+		libs = append(libs, &Lib{ModName: "example.com/shared", Path: t.TempDir(), Sum: sum, Config: spec})
+	}
+	config := Config{CacheDir: t.TempDir(), Logger: Discard}
+	ctx := context.Background()
+
+	for _, lib := range libs {
+		if err := BuildContext(ctx, config, []*Lib{lib}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "x"); n != 1 {
+		t.Fatalf("built %d times, want 1", n)
+	}
+
+	config.Goos, config.Goarch = "linux", "amd64"
+	var dirs []string
+	for _, lib := range libs {
+		if err := BuildContext(ctx, config, []*Lib{lib}); err != nil {
+			t.Fatal(err)
+		}
+		dir, err := getBuildDirByName(config, lib, BuildDirName, getTargetTriple("linux", "amd64"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, resolved)
+	}
+	if dirs[0] != dirs[1] {
+		t.Fatalf("module versions do not share the build: %v", dirs)
+	}
+
+	// A store dir stays while any module version links it
+	removed, err := PruneCache(config, PruneOptions{Keep: libs[1:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Store {
+		t.Fatalf("unexpected removed entries: %+v", removed)
+	}
+	if _, err := PruneCache(config, PruneOptions{Keep: []*Lib{}}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := CacheEntries(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("cache not empty: %+v", entries)
+	}
+}
+
+func TestStoreKeyIncludesPackageFiles(t *testing.T) {
+	config := Config{CacheDir: t.TempDir(), Goos: "linux", Goarch: "amd64"}
+	lib := &Lib{ModName: "example.com/patched", Path: t.TempDir(), Sum: "h1:x", Config: LibSpec{Name: "patched"}}
+	before, err := getStoreDir(context.Background(), config, lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lib.Path, "fix.patch"), []byte("--- a\n+++ b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after, err := getStoreDir(context.Background(), config, lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("store dir does not depend on patches")
+	}
+	before = after
+	if err := os.WriteFile(filepath.Join(lib.Path, "config.h"), []byte("#define X 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ = getStoreDir(context.Background(), config, lib); before == after {
+		t.Fatal("store dir does not depend on other package files")
+	}
+	// The build inputs of lib.yaml are hashed from the spec instead, and
+	// Go code does not affect the build
+	before = after
+	for name, content := range map[string]string{"lib.yaml": "name: patched\n", "go.mod": "module example.com/patched\n", "patched.go": "package patched\n"} {
+		if err := os.WriteFile(filepath.Join(lib.Path, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after, _ = getStoreDir(context.Background(), config, lib); before != after {
+		t.Fatal("store dir depends on lib.yaml or Go files")
+	}
+	config.Goarch = "arm64"
+	if other, _ := getStoreDir(context.Background(), config, lib); other == after {
+		t.Fatal("store dir does not depend on the target")
+	}
+}
+
+func TestStoreConcurrentBuilds(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "builds")
+	spec := LibSpec{
+		Name:    "locked",
+		Version: "1.0",
+		Build: &BuildSpec{
+			Command: `echo x >> ` + counter + `; sleep 0.3; echo lib > "$CLIBS_BUILD_DIR/liblocked.a"`,
+		},
+	}
+	config := Config{Goos: "linux", Goarch: "amd64", CacheDir: t.TempDir(), Logger: Discard}
+	ctx := context.Background()
+
+	var libs []*Lib
+	for _, sum := range []string{"h1:v010", "h1:v011"} {
+		libs = append(libs, &Lib{ModName: "example.com/locked", Path: t.TempDir(), Sum: sum, Config: spec})
+	}
+	errs := make(chan error, len(libs))
+	for _, lib := range libs {
+		go func(lib *Lib) {
+			errs <- BuildContext(ctx, config, []*Lib{lib})
+		}(lib)
+	}
+	for range libs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "x"); n != 1 {
+		t.Fatalf("built %d times, want 1", n)
+	}
+
+	// A failed build is not linked
+	failing := &Lib{ModName: "example.com/failing", Path: t.TempDir(), Sum: "h1:failing", Config: LibSpec{
+		Name:    "failing",
+		Version: "1.0",
+		Build:   &BuildSpec{Command: `echo partial > "$CLIBS_BUILD_DIR/libfailing.a"; exit 1`},
+	}}
+	if err := BuildContext(ctx, config, []*Lib{failing}); err == nil {
+		t.Fatal("failing build succeeded")
+	}
+	buildDir, err := getBuildDirByName(config, failing, BuildDirName, "x86_64-unknown-linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(buildDir); !os.IsNotExist(err) {
+		t.Fatalf("failed build linked at %s: %v", buildDir, err)
+	}
+}
@@ -0,0 +1,117 @@
+package clibs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// templateVars are the build env variables available to templates
+var templateVars = []string{
+	EnvPackageDir,
+	EnvDownloadDir,
+	EnvBuildGoos,
+	EnvBuildGoarch,
+	EnvBuildTarget,
+	EnvBuildCflags,
+	EnvBuildLdflags,
+	EnvBuildDir,
+	EnvBuildProfile,
+}
+
+// expandTemplate replaces ${VAR} in tmpl with lookup(VAR). "$$" is a
+// literal "$", any other "$" is an error so shell syntax like $VAR is not
+// silently kept.
+func expandTemplate(tmpl string, lookup func(name string) (string, error)) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(tmpl, '$')
+		if i < 0 {
+			b.WriteString(tmpl)
+			return b.String(), nil
+		}
+		b.WriteString(tmpl[:i])
+		rest := tmpl[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "$"):
+			b.WriteByte('$')
+			tmpl = rest[1:]
+		case strings.HasPrefix(rest, "{"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", tmpl)
+			}
+			value, err := lookup(rest[1:end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			tmpl = rest[end+1:]
+		default:
+			return "", fmt.Errorf("bare $ in %q, use ${VAR} or $$", tmpl)
+		}
+	}
+}
+
+// validateTemplate checks the syntax of tmpl and that it only uses
+// templateVars
+func validateTemplate(tmpl string) error {
+	_, err := expandTemplate(tmpl, func(name string) (string, error) {
+		for _, v := range templateVars {
+			if v == name {
+				return "", nil
+			}
+		}
+		return "", fmt.Errorf("unknown variable ${%s}, expected one of %s", name, strings.Join(templateVars, ", "))
+	})
+	return err
+}
+
+// Validate checks the declarative parts of the spec
+func (c *LibSpec) Validate() error {
+	for _, key := range sortedKeys(c.Exports) {
+		if !isEnvKey(key) {
+			return fmt.Errorf("exports: invalid variable name %q", key)
+		}
+		if err := validateTemplate(c.Exports[key]); err != nil {
+			return fmt.Errorf("exports: %s: %v", key, err)
+		}
+	}
+	return c.validatePkgConfig()
+}
+
+// expandExports evaluates the exports of the spec against env, a list of
+// KEY=VALUE, returning KEY=VALUE lines sorted by key
+func (c *LibSpec) expandExports(env []string) ([]string, error) {
+	values := make(map[string]string)
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			values[k] = v
+		}
+	}
+	lookup := func(name string) (string, error) {
+		v, ok := values[name]
+		if !ok {
+			return "", fmt.Errorf("${%s} is not set", name)
+		}
+		return v, nil
+	}
+	var lines []string
+	for _, key := range sortedKeys(c.Exports) {
+		value, err := expandTemplate(c.Exports[key], lookup)
+		if err != nil {
+			return nil, fmt.Errorf("exports: %s: %v", key, err)
+		}
+		lines = append(lines, key+"="+value)
+	}
+	return lines, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
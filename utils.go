@@ -1,76 +1,193 @@
 package clibs
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-func getBuildDirByName(lib *Lib, dirName, platform, arch, targetTriple string) string {
-	return filepath.Join(getBuildBaseDir(lib), dirName, targetTriple)
+func getBuildDirByName(config Config, lib *Lib, dirName, targetDirName string) (string, error) {
+	baseDir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(baseDir, dirName, targetDirName), nil
 }
 
 // getDownloadDir returns the download directory
-func getDownloadDir(lib *Lib) string {
-	return filepath.Join(getBuildBaseDir(lib), DownloadDirName)
+func getDownloadDir(config Config, lib *Lib) (string, error) {
+	baseDir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(baseDir, DownloadDirName), nil
 }
 
-func getPrebuiltDir(lib *Lib) string {
-	return filepath.Join(getBuildBaseDir(lib), PrebuiltDirName)
+func getPrebuiltDir(config Config, lib *Lib) (string, error) {
+	baseDir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(baseDir, PrebuiltDirName), nil
 }
 
-func getBuildBaseDir(lib *Lib) string {
-	if lib.Sum == "" {
-		return lib.Path
+// listTargetDirs returns every build and prebuilt target directory of lib
+// that holds a build state
+func listTargetDirs(config Config, lib *Lib) ([]string, error) {
+	baseDir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, dirName := range []string{BuildDirName, PrebuiltDirName} {
+		root := filepath.Join(baseDir, dirName)
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			dir := filepath.Join(root, entry.Name())
+			if _, err := os.Stat(filepath.Join(dir, BuildHashFile)); err == nil {
+				dirs = append(dirs, dir)
+			}
+		}
 	}
-	home, err := os.UserHomeDir()
+	return dirs, nil
+}
+
+// getBuildBaseDir returns the dir holding the download, build and prebuilt
+// dirs of lib: the cache for versioned modules, the source dir for local
+// modules unless config keeps them out of tree.
+func getBuildBaseDir(config Config, lib *Lib) (string, error) {
+	if lib.Sum == "" && !config.outOfTree() {
+		return lib.Path, nil
+	}
+	root, err := config.cacheRoot()
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+	return filepath.Join(root, filepath.FromSlash(escapeModulePath(lib.ModName)), cacheKey(lib)), nil
+}
+
+// cacheKey returns the directory name of a module version in the cache.
+// The base64 sum is made URL safe so it never contains a path separator,
+// local modules are keyed by their source dir.
+func cacheKey(lib *Lib) string {
+	if lib.Sum == "" {
+		sum := sha256.Sum256([]byte(filepath.Clean(lib.Path)))
+		return "local-" + hex.EncodeToString(sum[:8])
+	}
+	key := lib.Sum
+	if algo, value, ok := strings.Cut(lib.Sum, ":"); ok {
+		key = value
+		if algo != "h1" {
+			key = algo + "-" + value
+		}
+	}
+	return strings.NewReplacer("/", "_", "+", "-").Replace(key)
+}
+
+// escapeModulePath escapes upper case letters like the Go module cache
+// does, so module paths differing only in case do not collide on case
+// insensitive file systems.
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unescapeModulePath reverses escapeModulePath
+func unescapeModulePath(path string) string {
+	var b strings.Builder
+	bang := false
+	for _, r := range path {
+		if bang && 'a' <= r && r <= 'z' {
+			r -= 'a' - 'A'
+		} else if r == '!' {
+			bang = true
+			continue
+		}
+		bang = false
+		b.WriteRune(r)
 	}
-	subDir := strings.TrimLeft(lib.Sum, "h1:")
-	return filepath.Join(home, ".llgo/", "clibs_build", lib.ModName, subDir)
+	return b.String()
 }
 
-// checkHash verifies if the build hash matches
-func checkHash(dir string, config LibSpec, build bool) (bool, error) {
-	var configHash LibSpec
-	if build {
-		configHash = config.BuildHash()
-	} else {
-		configHash = config.DownloadHash()
+// migrateLegacyBaseDir moves the build state of lib from the cache layout
+// of older versions, which trimmed "h1:" as a cutset and kept "/" of the
+// sum, to the current location.
+func migrateLegacyBaseDir(config Config, lib *Lib) error {
+	if lib.Sum == "" {
+		return nil
+	}
+	baseDir, err := getBuildBaseDir(config, lib)
+	if err != nil {
+		return err
+	}
+	root, err := config.cacheRoot()
+	if err != nil {
+		return err
+	}
+	legacyDir := filepath.Join(root, lib.ModName, strings.TrimLeft(lib.Sum, "h1:"))
+	if legacyDir == baseDir {
+		return nil
+	}
+	if _, err := os.Stat(baseDir); err == nil {
+		return nil
 	}
+	if fi, err := os.Stat(legacyDir); err != nil || !fi.IsDir() || !isCacheEntry(legacyDir) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(baseDir), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(legacyDir, baseDir); err != nil {
+		return fmt.Errorf("failed to migrate %s: %v", legacyDir, err)
+	}
+	// Drop the dirs left empty by sums containing "/"
+	for dir := filepath.Dir(legacyDir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
 
-	hashContent, err := os.ReadFile(filepath.Join(dir, BuildHashFile))
+// checkHash verifies if the build state in dir matches the inputs
+func checkHash(log libLogger, dir string, inputs StateInputs) (bool, error) {
+	state, err := ReadBuildState(dir)
 	if err != nil {
-		fmt.Printf("read hash file failed: %v, %s", err, filepath.Join(dir, BuildHashFile))
 		return false, err
 	}
 
-	hash, err := json.MarshalIndent(configHash, "", "  ")
+	expected, err := inputs.Digest()
 	if err != nil {
 		return false, err
 	}
-	hashStr := string(hash)
-
-	fmt.Printf("  Checking hash, equal: %v, %s, %s\n", hashStr == string(hashContent), hashStr, string(hashContent))
-	return hashStr == string(hashContent), nil
-}
+	matched := state.Digest == expected
 
-func saveHash(dir string, config LibSpec, build bool) error {
-	var configHash LibSpec
-	if build {
-		configHash = config.BuildHash()
-	} else {
-		configHash = config.DownloadHash()
+	// A failed migration is retried on the next check
+	if matched && state.Version < BuildStateVersion {
+		if err := migrateBuildState(dir, state); err != nil {
+			log.debugf("Failed to migrate build state in %s: %v", dir, err)
+		}
 	}
+	return matched, nil
+}
 
-	content, err := json.MarshalIndent(configHash, "", "  ")
+func saveHash(dir string, inputs StateInputs) error {
+	state, err := newBuildState(inputs)
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("  Saving hash: %#v\n     to %s\n", configHash, filepath.Join(dir, BuildHashFile))
-	return os.WriteFile(filepath.Join(dir, BuildHashFile), content, 0644)
+	return writeBuildState(dir, state)
 }